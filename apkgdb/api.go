@@ -0,0 +1,482 @@
+package apkgdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The JSON API is served under /v1/ below the database's control URL, for
+// example /apkgdb/main/v1/status. The "sub" query parameter selects a sub
+// database the same way as for the text interface. Errors are returned as
+// {"error": "..."} with an appropriate status code. Endpoints are read-only
+// except for starting a prefetch with POST v1/prefetch, which only accepts a
+// JSON body from the local host so that web pages cannot trigger it.
+
+// APIStatus is returned by v1/status.
+type APIStatus struct {
+	Name       string         `json:"name"`
+	OS         string         `json:"os"`
+	Arch       string         `json:"arch"`
+	Version    string         `json:"version"`
+	MaxVersion string         `json:"max_version"`
+	Channel    string         `json:"channel"`
+	ChannelMap []ChannelRule  `json:"channel_map,omitempty"`
+	Packages   int            `json:"packages"`
+	Unsigned   int            `json:"unsigned"`
+	Mirrors    []MirrorStatus `json:"mirrors"`
+	CacheUsage int64          `json:"cache_usage"`
+	CacheLimit int64          `json:"cache_limit"`
+	Subs       []string       `json:"subs"`
+}
+
+// APIPackage describes a package in v1/packages.
+type APIPackage struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash,omitempty"`
+	Size   uint64 `json:"size,omitempty"`
+	Inodes uint64 `json:"inodes,omitempty"`
+	Signed bool   `json:"signed"`
+}
+
+// APIPackageList is returned by v1/packages.
+type APIPackageList struct {
+	Total    int           `json:"total"`
+	Offset   int           `json:"offset"`
+	Packages []*APIPackage `json:"packages"`
+}
+
+// APIPackageInfo is returned by v1/package, Meta is the PackageMeta stored
+// in the database.
+type APIPackageInfo struct {
+	APIPackage
+	Path     string          `json:"path"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	Download *DownloadState  `json:"download"`
+}
+
+// APIPrefetchRequest is the body of POST v1/prefetch.
+type APIPrefetchRequest struct {
+	Names []string `json:"names"`
+}
+
+// APISub describes a loaded sub database in v1/subs.
+type APISub struct {
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Version string `json:"version"`
+}
+
+// DownloadState describes the local copy of a package.
+type DownloadState struct {
+	Name     string `json:"name"`
+	State    string `json:"state"` // "none", "downloading" or "ready"
+	Mirror   string `json:"mirror,omitempty"`
+	Blocks   int    `json:"blocks"`   // number of data blocks
+	Verified int    `json:"verified"` // blocks checked against the hash table
+	Disk     int64  `json:"disk"`     // bytes used in the local cache
+}
+
+func (d *DB) serveAPI(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if r.Method == http.MethodPost && endpoint == "prefetch" {
+		d.apiPrefetch(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		apiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	switch endpoint {
+	case "status":
+		apiResult(w, d.apiStatus())
+	case "packages":
+		limit, err1 := queryInt(q.Get("limit"), 0)
+		offset, err2 := queryInt(q.Get("offset"), 0)
+		if err := errors.Join(err1, err2); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, err := d.apiPackages(q.Get("prefix"), q.Get("q"), offset, limit)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiResult(w, res)
+	case "package":
+		name := q.Get("name")
+		if name == "" {
+			apiError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		res, err := d.apiPackage(name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				apiError(w, http.StatusNotFound, err)
+			} else {
+				apiError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		apiResult(w, res)
+	case "pins":
+		pins := d.AllPins()
+		if ch := q.Get("channel"); ch != "" {
+			pins = map[string]map[string]string{ch: pins[ch]}
+			if pins[ch] == nil {
+				pins[ch] = map[string]string{}
+			}
+		}
+		apiResult(w, pins)
+	case "pins/effective":
+		apiResult(w, d.EffectivePins())
+	case "provides":
+		limit, err := queryInt(q.Get("limit"), 0)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		path, prefix := q.Get("path"), false
+		if path == "" {
+			path, prefix = q.Get("prefix"), true
+		}
+		if path == "" {
+			apiError(w, http.StatusBadRequest, errors.New("path or prefix is required"))
+			return
+		}
+		res, err := d.Provides(path, prefix, limit)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiResult(w, res)
+	case "subs":
+		apiResult(w, d.apiSubs())
+	case "downloads":
+		apiResult(w, d.Downloads())
+	case "prefetch":
+		if q.Get("id") == "" {
+			apiResult(w, d.PrefetchJobs())
+			return
+		}
+		id, err := queryInt(q.Get("id"), 0)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, err := d.PrefetchStatus(id)
+		if err != nil {
+			apiError(w, http.StatusNotFound, errors.New("unknown prefetch job"))
+			return
+		}
+		apiResult(w, res)
+	default:
+		apiError(w, http.StatusNotFound, errors.New("unknown endpoint"))
+	}
+}
+
+// apiPrefetch starts a prefetch job. Browsers can send cross-site form posts
+// to the control interface, but not JSON ones without a preflight request.
+func (d *DB) apiPrefetch(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		apiError(w, http.StatusForbidden, errors.New("prefetch is only allowed from the local host"))
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		apiError(w, http.StatusUnsupportedMediaType, errors.New("expected a JSON request"))
+		return
+	}
+
+	var req APIPrefetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := d.Prefetch(req.Names)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			apiError(w, http.StatusNotFound, err)
+		} else {
+			apiError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	w.Header().Set("Location", r.URL.Path+"?id="+strconv.Itoa(res.ID))
+	apiResultCode(w, http.StatusAccepted, res)
+}
+
+func apiResult(w http.ResponseWriter, v any) {
+	apiResultCode(w, http.StatusOK, v)
+}
+
+func apiResultCode(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, errors.New("invalid number " + strconv.Quote(s))
+	}
+	return v, nil
+}
+
+func (d *DB) apiStatus() *APIStatus {
+	res := &APIStatus{
+		Name:       d.name,
+		OS:         d.os,
+		Arch:       d.arch,
+		Version:    d.CurrentVersion(),
+		MaxVersion: d.MaxVersion(),
+		Channel:    d.channel,
+		ChannelMap: d.ChannelMap(),
+		Unsigned:   len(listUnsigned(d.osV, d.archV)),
+		Mirrors:    d.Mirrors(),
+		Subs:       []string{},
+	}
+	res.CacheUsage, res.CacheLimit, _ = d.CacheUsage()
+
+	for _, sub := range d.ListSubs() {
+		res.Subs = append(res.Subs, sub.String())
+	}
+	sort.Strings(res.Subs)
+
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr != nil {
+		_ = d.dbptr.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte("p2p")); b != nil {
+				res.Packages = b.Stats().KeyN
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// apiPackages lists packages whose name starts with prefix and contains
+// search, in the same order as the text list.
+func (d *DB) apiPackages(prefix, search string, offset, limit int) (*APIPackageList, error) {
+	match := func(name string) bool {
+		return strings.HasPrefix(name, prefix) && strings.Contains(name, search)
+	}
+
+	var list []*APIPackage
+	for _, name := range listUnsigned(d.osV, d.archV) {
+		if match(name) {
+			list = append(list, &APIPackage{Name: name})
+		}
+	}
+
+	d.dbrw.RLock()
+	if d.dbptr != nil {
+		err := d.dbptr.View(func(tx *bolt.Tx) error {
+			p2pB := tx.Bucket([]byte("p2p"))
+			pkgB := tx.Bucket([]byte("pkg"))
+			if p2pB == nil || pkgB == nil {
+				return nil
+			}
+			return p2pB.ForEach(func(k, v []byte) error {
+				if len(v) < 32+8 {
+					return nil
+				}
+				name := string(v[32+8:])
+				if !match(name) {
+					return nil
+				}
+				p := &APIPackage{Name: name, Hash: hex.EncodeToString(v[:32]), Signed: true}
+				if info := pkgB.Get(v[:32]); len(info) >= 25 {
+					p.Size = binary.BigEndian.Uint64(info[1:9])
+					p.Inodes = binary.BigEndian.Uint64(info[17:25])
+				}
+				list = append(list, p)
+				return nil
+			})
+		})
+		if err != nil {
+			d.dbrw.RUnlock()
+			return nil, err
+		}
+	}
+	d.dbrw.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool { return natsortCompare(list[i].Name, list[j].Name) })
+
+	res := &APIPackageList{Total: len(list), Offset: offset, Packages: []*APIPackage{}}
+	if offset < len(list) {
+		list = list[offset:]
+		if limit > 0 && limit < len(list) {
+			list = list[:limit]
+		}
+		res.Packages = list
+	}
+	return res, nil
+}
+
+// apiPackage returns information on a signed package. name is resolved the
+// same way as a lookup on the filesystem, but the package is read from the
+// database without being loaded.
+func (d *DB) apiPackage(name string) (*APIPackageInfo, error) {
+	if lookupUnsigned(d.osV, d.archV, name) != nil {
+		return nil, errors.New("not a signed package")
+	}
+
+	var res *APIPackageInfo
+	var key pkgKey
+
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr == nil {
+		return nil, ErrDatabaseClosed
+	}
+
+	err := d.dbptr.View(func(tx *bolt.Tx) error {
+		v, _, err := d.resolveTx(tx, d.channel, name)
+		if err != nil {
+			return err
+		}
+		pkgB := tx.Bucket([]byte("pkg"))
+		pathB := tx.Bucket([]byte("path"))
+		metaB := tx.Bucket([]byte("meta"))
+		if pkgB == nil || pathB == nil || metaB == nil {
+			return os.ErrInvalid
+		}
+		info := pkgB.Get(v[:32])
+		if len(info) < 25 {
+			return os.ErrInvalid
+		}
+
+		res = &APIPackageInfo{
+			APIPackage: APIPackage{
+				Name:   string(info[25:]),
+				Hash:   hex.EncodeToString(v[:32]),
+				Size:   binary.BigEndian.Uint64(info[1:9]),
+				Inodes: binary.BigEndian.Uint64(info[17:25]),
+				Signed: true,
+			},
+			Path: string(pathB.Get(v[:32])),
+		}
+		if meta := metaB.Get(v[:32]); json.Valid(meta) {
+			res.Meta = bytesDup(meta)
+		}
+		key.db = d
+		copy(key.hash[:], v[:32])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// only report the download state of a package already loaded
+	root := d.cacheRoot()
+	root.pkgCacheL.RLock()
+	p := root.pkgCache[key]
+	root.pkgCacheL.RUnlock()
+	if p != nil {
+		res.Download = p.downloadState()
+	} else {
+		res.Download = &DownloadState{Name: res.Name, State: "none"}
+	}
+	return res, nil
+}
+
+func (d *DB) apiSubs() []*APISub {
+	res := []*APISub{}
+	for _, archos := range d.ListSubs() {
+		sub, err := d.SubGet(archos)
+		if err != nil {
+			continue
+		}
+		res = append(res, &APISub{OS: sub.os, Arch: sub.arch, Version: sub.CurrentVersion()})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].OS+"."+res[i].Arch < res[j].OS+"."+res[j].Arch
+	})
+	return res
+}
+
+// Downloads returns the download state of the packages of this database
+// that have been accessed since the daemon started.
+func (d *DB) Downloads() []*DownloadState {
+	var pkgs []*Package
+	root := d.cacheRoot()
+	root.pkgCacheL.RLock()
+	for _, p := range root.pkgCache {
+		if p.parent == d {
+			pkgs = append(pkgs, p)
+		}
+	}
+	root.pkgCacheL.RUnlock()
+
+	res := make([]*DownloadState, 0, len(pkgs))
+	for _, p := range pkgs {
+		res = append(res, p.downloadState())
+	}
+	sort.Slice(res, func(i, j int) bool { return natsortCompare(res[i].Name, res[j].Name) })
+	return res
+}
+
+// downloadState returns the state of the package's local copy.
+func (p *Package) downloadState() *DownloadState {
+	res := &DownloadState{Name: p.name, State: "none"}
+
+	if p.dlMu.TryLock() {
+		if p.dlDone {
+			res.State = "ready"
+		}
+		p.dlMu.Unlock()
+	} else {
+		res.State = "downloading"
+	}
+
+	p.fLk.RLock()
+	if p.f != nil && p.mirror != nil {
+		res.Mirror = p.mirror.prefix
+	}
+	p.fLk.RUnlock()
+
+	p.blkLk.Lock()
+	res.Blocks = len(p.blocks) / 32
+	for _, v := range p.blkOk {
+		res.Verified += bits.OnesCount64(v)
+	}
+	p.blkLk.Unlock()
+
+	lpath := p.lpath()
+	if fi, err := os.Stat(lpath); err == nil {
+		res.Disk = diskUsage(fi)
+	}
+	if fi, err := os.Stat(lpath + ".part"); err == nil {
+		res.Disk += diskUsage(fi)
+	}
+	return res
+}
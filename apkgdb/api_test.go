@@ -0,0 +1,173 @@
+package apkgdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// addTestPackages stores packages in the database the same way index() does,
+// with meta as their metadata. Package hashes are the sha256 of their name.
+func addTestPackages(t *testing.T, d *DB, meta string, names ...string) {
+	t.Helper()
+	err := d.dbptr.Update(func(tx *bolt.Tx) error {
+		p2p, err := tx.CreateBucketIfNotExists([]byte("p2p"))
+		if err != nil {
+			return err
+		}
+		pkg, err := tx.CreateBucketIfNotExists([]byte("pkg"))
+		if err != nil {
+			return err
+		}
+		for _, b := range []string{"path", "header", "sig", "meta"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range names {
+			h := sha256.Sum256([]byte(name))
+			hash := h[:]
+			inoCount := make([]byte, 8)
+			binary.BigEndian.PutUint64(inoCount, 10)
+
+			p2pVal := append(append(append([]byte(nil), hash...), inoCount...), name...)
+			if err := p2p.Put(collatedVersion(name), p2pVal); err != nil {
+				return err
+			}
+
+			sizeB := make([]byte, 8)
+			binary.BigEndian.PutUint64(sizeB, 4096)
+			pkgVal := append(append(append(append([]byte{0}, sizeB...), make([]byte, 8)...), inoCount...), name...)
+			if err := pkg.Put(hash, pkgVal); err != nil {
+				return err
+			}
+
+			tx.Bucket([]byte("path")).Put(hash, []byte("core/"+name+".apkg"))
+			tx.Bucket([]byte("header")).Put(hash, []byte{})
+			tx.Bucket([]byte("sig")).Put(hash, []byte{})
+			tx.Bucket([]byte("meta")).Put(hash, []byte(meta))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func apiGet(t *testing.T, d *DB, url string, code int, v any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+	if w.Code != code {
+		t.Fatalf("GET %s: expected status %d, got %d: %s", url, code, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: unexpected content type %q", url, ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: invalid JSON: %s", url, err)
+	}
+}
+
+func TestAPIPackages(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.mirrors = parseMirrors("")
+
+	addTestPackages(t, d, `{"name":"x"}`,
+		"core.zlib.1.3.linux.amd64",
+		"core.zlib.1.10.linux.amd64",
+		"core.openssl.3.0.linux.amd64",
+		"dev-lang.python.3.12.linux.amd64",
+	)
+
+	var st APIStatus
+	apiGet(t, d, "/apkgdb/test/v1/status", http.StatusOK, &st)
+	if st.Name != "test" || st.Packages != 4 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	var list APIPackageList
+	apiGet(t, d, "/apkgdb/test/v1/packages?prefix=core.", http.StatusOK, &list)
+	if list.Total != 3 || len(list.Packages) != 3 {
+		t.Fatalf("expected 3 core packages, got %+v", list)
+	}
+	// natural order, 1.3 before 1.10
+	if list.Packages[1].Name != "core.zlib.1.3.linux.amd64" || list.Packages[2].Name != "core.zlib.1.10.linux.amd64" {
+		t.Errorf("unexpected order: %s, %s", list.Packages[1].Name, list.Packages[2].Name)
+	}
+	if p := list.Packages[0]; !p.Signed || p.Size != 4096 || p.Inodes != 10 || len(p.Hash) != 64 {
+		t.Errorf("unexpected package %+v", p)
+	}
+
+	apiGet(t, d, "/apkgdb/test/v1/packages?q=zlib&offset=1&limit=5", http.StatusOK, &list)
+	if list.Total != 2 || len(list.Packages) != 1 || list.Packages[0].Name != "core.zlib.1.10.linux.amd64" {
+		t.Errorf("unexpected paged result %+v", list)
+	}
+
+	var apiErr map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/packages?limit=x", http.StatusBadRequest, &apiErr)
+	if apiErr["error"] == "" {
+		t.Errorf("expected error message")
+	}
+	apiGet(t, d, "/apkgdb/test/v1/nothing", http.StatusNotFound, &apiErr)
+}
+
+func TestAPIPackage(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.mirrors = parseMirrors("")
+
+	addTestPackages(t, d, `{"name":"core.zlib","version":"1.3"}`, "core.zlib.1.3.linux.amd64")
+
+	var info APIPackageInfo
+	apiGet(t, d, "/apkgdb/test/v1/package?name=core.zlib", http.StatusOK, &info)
+	if info.Name != "core.zlib.1.3.linux.amd64" || info.Path != "core/core.zlib.1.3.linux.amd64.apkg" {
+		t.Errorf("unexpected package info %+v", info)
+	}
+	var meta PackageMeta
+	if err := json.Unmarshal(info.Meta, &meta); err != nil || meta.Version != "1.3" {
+		t.Errorf("unexpected meta %s", info.Meta)
+	}
+	if info.Download == nil || info.Download.State != "none" {
+		t.Errorf("unexpected download state %+v", info.Download)
+	}
+
+	// querying a package does not load it
+	var downloads []*DownloadState
+	apiGet(t, d, "/apkgdb/test/v1/downloads", http.StatusOK, &downloads)
+	if len(downloads) != 0 {
+		t.Errorf("unexpected downloads %+v", downloads)
+	}
+
+	var apiErr map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/package?name=core.nothing", http.StatusNotFound, &apiErr)
+}
+
+func TestAPIPins(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	d.SetPin("stable", "sys-libs.glibc", "2.41")
+	d.SetPin("stable", "dev-lang.python", "3.11")
+	d.SetPin("testing", "dev-lang.python", "3.12")
+
+	var pins map[string]map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/pins", http.StatusOK, &pins)
+	if len(pins) != 2 || pins["stable"]["sys-libs.glibc"] != "2.41" || pins["testing"]["dev-lang.python"] != "3.12" {
+		t.Errorf("unexpected pins %v", pins)
+	}
+
+	var other map[string]map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/pins?channel=other", http.StatusOK, &other)
+	if len(other) != 1 || len(other["other"]) != 0 {
+		t.Errorf("unexpected pins for unknown channel %v", other)
+	}
+}
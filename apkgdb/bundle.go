@@ -0,0 +1,290 @@
+package apkgdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A bundle is a tar archive containing a signed database and a set of
+// packages, laid out like the download server:
+//
+//	db/<name>/<os>/<arch>/LATEST.jwt
+//	db/<name>/<os>/<arch>/<version>.bin
+//	dist/<name>/<package path>
+//
+// It allows machines without network access to receive updates. Everything
+// in a bundle is verified the same way as downloaded data.
+
+// ExportBundle writes a bundle containing the latest signed database and the
+// packages matching the given names to w. Names are resolved the same way
+// as lookups on the filesystem.
+func (d *DB) ExportBundle(w io.Writer, names []string) error {
+	dbpath := "db/" + d.name + "/" + d.os + "/" + d.arch + "/"
+
+	resp, err := d.mirrors.get(dbpath+"LATEST.jwt", nil)
+	if err != nil {
+		return err
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to fetch information on latest database version: %s", resp.Status)
+	}
+	token = bytes.TrimSpace(token)
+
+	version, err := d.verifyLatest(token)
+	if err != nil {
+		return err
+	}
+
+	// download full database, the same file is indexed below when opened
+	// with NewExport
+	bin, err := d.downloadFull(dbpath + version + ".bin")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bin.Name())
+	defer bin.Close()
+
+	st, err := bin.Stat()
+	if err != nil {
+		return err
+	}
+	binSize := st.Size()
+
+	// make sure we are at the same version to resolve package names
+	if version != d.CurrentVersion() {
+		if err := d.index(bin); err != nil {
+			return err
+		}
+	}
+
+	var pkgs []*Package
+	for _, name := range names {
+		n, err := d.internalLookup(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		p, ok := d.pkgByIno(n).(*Package)
+		if !ok {
+			return fmt.Errorf("%s: not a signed package", name)
+		}
+		pkgs = append(pkgs, p)
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	if err := tw.WriteHeader(&tar.Header{Name: dbpath + "LATEST.jwt", Mode: 0644, Size: int64(len(token)), ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(token); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: dbpath + version + ".bin", Mode: 0644, Size: binSize, ModTime: now}); err != nil {
+		return err
+	}
+	if _, err = bin.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, bin); err != nil {
+		return err
+	}
+
+	for _, p := range pkgs {
+		log.Printf("apkgdb: adding %s to bundle", p.name)
+		if err := p.exportTo(tw, now); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// downloadFull downloads a database file from the mirrors to a temporary
+// file.
+func (d *DB) downloadFull(rpath string) (*os.File, error) {
+	resp, err := d.mirrors.get(rpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch latest database: %s", resp.Status)
+	}
+
+	bin, err := os.CreateTemp("", "apkg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(bin, resp.Body); err == nil {
+		_, err = bin.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		bin.Close()
+		os.Remove(bin.Name())
+		return nil, err
+	}
+	return bin, nil
+}
+
+// exportTo writes the package file to a bundle
+func (p *Package) exportTo(tw *tar.Writer, now time.Time) error {
+	resp, err := p.parent.mirrors.get(p.remotePath(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to fetch package: %s", resp.Status)
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: "dist/" + p.parent.name + "/" + p.path, Mode: 0644, Size: int64(p.size), ModTime: now})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, resp.Body, int64(p.size))
+	return err
+}
+
+// ImportBundle reads a bundle created by ExportBundle. The database it
+// contains is verified and indexed like a downloaded one, and packages are
+// stored in the local cache where they are verified on access.
+func (d *DB) ImportBundle(r io.Reader) error {
+	tr := tar.NewReader(r)
+	dbpath := "db/" + d.name + "/" + d.os + "/" + d.arch + "/"
+	distpath := "dist/" + d.name + "/"
+	var version string
+	var count int
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch {
+		case hdr.Name == dbpath+"LATEST.jwt":
+			token, err := io.ReadAll(io.LimitReader(tr, 64*1024))
+			if err != nil {
+				return err
+			}
+			version, err = d.verifyLatest(bytes.TrimSpace(token))
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(hdr.Name, dbpath) && strings.HasSuffix(hdr.Name, ".bin"):
+			if version == "" {
+				return errors.New("database in bundle is not preceded by LATEST.jwt")
+			}
+			if hdr.Name != dbpath+version+".bin" {
+				return fmt.Errorf("unexpected database file %s in bundle for version %s", hdr.Name, version)
+			}
+			if version == d.CurrentVersion() {
+				log.Printf("apkgdb: %s database is already at version %s", d.name, version)
+				continue
+			}
+			log.Printf("apkgdb: importing %s database version %s ...", d.name, version)
+			if err := d.indexFrom(tr); err != nil {
+				return err
+			}
+		case strings.HasPrefix(hdr.Name, distpath):
+			ok, err := d.importPackageFile(strings.TrimPrefix(hdr.Name, distpath), tr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if ok {
+				count += 1
+			}
+		default:
+			log.Printf("apkgdb: ignoring %s in bundle", hdr.Name)
+		}
+	}
+
+	log.Printf("apkgdb: imported bundle with %d new packages", count)
+	return nil
+}
+
+// importPackageFile stores a package file from a bundle in the local cache,
+// unless a complete copy is already there or it is currently being used.
+func (d *DB) importPackageFile(rpath string, r io.Reader) (bool, error) {
+	if !filepath.IsLocal(rpath) || path.Clean(rpath) != rpath || !strings.HasSuffix(rpath, ".apkg") {
+		return false, errors.New("invalid package path")
+	}
+	lpath := filepath.Join(d.path, d.name, filepath.FromSlash(rpath))
+
+	if _, err := os.Stat(lpath); err == nil {
+		if _, err := os.Stat(lpath + ".part"); os.IsNotExist(err) {
+			// already complete
+			return false, nil
+		}
+	}
+
+	if d.pathInUse(lpath) {
+		log.Printf("apkgdb: not importing %s as it is in use", rpath)
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(lpath), 0755); err != nil {
+		return false, err
+	}
+	tmp := lpath + ".import"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	// without a .part file, the file is considered complete
+	os.Remove(lpath + ".part")
+	if err := os.Rename(tmp, lpath); err != nil {
+		return false, err
+	}
+	d.cacheUpdate(lpath)
+	return true, nil
+}
+
+// pathInUse returns true if a loaded package is using the given local file.
+func (d *DB) pathInUse(lpath string) bool {
+	root := d.cacheRoot()
+	root.pkgCacheL.RLock()
+	defer root.pkgCacheL.RUnlock()
+
+	p, ok := root.pkgPaths[lpath]
+	if !ok {
+		return false
+	}
+	if !p.dlMu.TryLock() {
+		// being downloaded
+		return true
+	}
+	defer p.dlMu.Unlock()
+	return p.dlDone
+}
@@ -0,0 +1,121 @@
+package apkgdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestImportPackageFile(t *testing.T) {
+	d := &DB{path: t.TempDir(), name: "test"}
+	lpath := filepath.Join(d.path, "test", "core/foo/core.foo.1.0.linux.amd64-abcdef0.apkg")
+
+	for _, bad := range []string{"../x.apkg", "/etc/x.apkg", "a/../../x.apkg", "a//b.apkg", "core/foo/notes.txt"} {
+		if _, err := d.importPackageFile(bad, strings.NewReader("data")); err == nil {
+			t.Errorf("expected path %q to be rejected", bad)
+		}
+	}
+
+	// partial download gets replaced
+	if err := os.MkdirAll(filepath.Dir(lpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lpath, []byte("part"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lpath+".part", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := d.importPackageFile("core/foo/core.foo.1.0.linux.amd64-abcdef0.apkg", strings.NewReader("full"))
+	if err != nil || !ok {
+		t.Fatalf("import failed: %v", err)
+	}
+	if data, _ := os.ReadFile(lpath); string(data) != "full" {
+		t.Errorf("unexpected file content %q", data)
+	}
+	if _, err := os.Stat(lpath + ".part"); !os.IsNotExist(err) {
+		t.Errorf(".part file should have been removed")
+	}
+
+	// complete file is kept
+	ok, err = d.importPackageFile("core/foo/core.foo.1.0.linux.amd64-abcdef0.apkg", strings.NewReader("other"))
+	if err != nil || ok {
+		t.Errorf("expected complete file to be skipped, got %v, %v", ok, err)
+	}
+	if data, _ := os.ReadFile(lpath); string(data) != "full" {
+		t.Errorf("complete file was overwritten")
+	}
+}
+
+func TestImportBundleRequiresToken(t *testing.T) {
+	d := &DB{path: t.TempDir(), name: "test", os: "linux", arch: "amd64"}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	data := []byte("APDB")
+	if err := tw.WriteHeader(&tar.Header{Name: "db/test/linux/amd64/20250101000000.bin", Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(data)
+	tw.Close()
+
+	if err := d.ImportBundle(buf); err == nil {
+		t.Errorf("expected database without LATEST.jwt to be rejected")
+	}
+}
+
+func TestExportBundleDownloadsOnce(t *testing.T) {
+	srvDB, cleanup := newTestDB(t)
+	defer cleanup()
+	key := newTestExportKey(t)
+	addTestPackages(t, srvDB, `{}`, "core.zlib.1.3.linux.amd64")
+	if err := srvDB.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+
+	var bins atomic.Int32
+	files := http.StripPrefix("/db/test/linux/amd64/", http.FileServer(http.Dir(srvDB.path)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".bin") {
+			bins.Add(1)
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	d, cleanup2 := newTestDB(t)
+	defer cleanup2()
+	d.mirrors = parseMirrors(srv.URL)
+
+	// like NewExport, the database was not downloaded when opened
+	buf := &bytes.Buffer{}
+	if err := d.ExportBundle(buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := bins.Load(); n != 1 {
+		t.Errorf("expected the database to be downloaded once, got %d", n)
+	}
+	if v := d.CurrentVersion(); v != srvDB.CurrentVersion() {
+		t.Errorf("downloaded database not indexed: version %q, want %q", v, srvDB.CurrentVersion())
+	}
+
+	tr := tar.NewReader(buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if want := "db/test/linux/amd64/" + srvDB.CurrentVersion() + ".bin"; len(names) != 2 || names[1] != want {
+		t.Errorf("unexpected bundle content %v", names)
+	}
+}
@@ -0,0 +1,331 @@
+package apkgdb
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// amount of data to try to free when a write fails because the disk is full
+const cacheEnospcFree = 256 * 1024 * 1024
+
+var errCacheNotScanned = errors.New("package cache not scanned yet")
+
+// cacheFile is a package file in the local download cache
+type cacheFile struct {
+	path  string
+	usage int64 // bytes used on disk, including .part file
+	atime time.Time
+	pkg   *Package // nil if package is not loaded, only set while evicting
+}
+
+// SetCacheLimit sets the maximum amount of disk space used by downloaded
+// packages. When the limit is exceeded, packages not currently in use are
+// removed least recently used first, and will be downloaded again when
+// needed. A limit of zero disables the check.
+func (d *DB) SetCacheLimit(limit int64) {
+	d = d.cacheRoot()
+	d.cacheLimit.Store(limit)
+	go func() {
+		if _, err := d.cacheScan(); err != nil {
+			log.Printf("apkgdb: failed to scan cache: %s", err)
+		}
+		d.cacheCheck()
+	}()
+}
+
+// CacheUsage returns the amount of disk space used by downloaded packages,
+// and the configured limit. The usage is tracked as package files are added
+// and removed, and is not known until the cache was scanned once after
+// SetCacheLimit.
+func (d *DB) CacheUsage() (usage, limit int64, err error) {
+	d = d.cacheRoot()
+	d.cacheStLk.Lock()
+	if d.cacheFiles == nil {
+		err = errCacheNotScanned
+	}
+	usage = d.cacheUsed
+	d.cacheStLk.Unlock()
+	return usage, d.cacheLimit.Load(), err
+}
+
+// cacheScan scans the cache directory if it was not yet, and returns its
+// disk usage.
+func (d *DB) cacheScan() (int64, error) {
+	d = d.cacheRoot()
+	d.cacheStLk.Lock()
+	defer d.cacheStLk.Unlock()
+
+	err := d.cacheLoad()
+	return d.cacheUsed, err
+}
+
+// cacheRoot returns the database owning the cache, sub databases store
+// their packages in the same directory as their parent.
+func (d *DB) cacheRoot() *DB {
+	for d.parent != nil {
+		d = d.parent
+	}
+	return d
+}
+
+// cacheLoad scans the cache directory the first time its usage is needed.
+// The usage is then kept up to date by cacheUpdate as package files are
+// added, grow and are removed. cacheStLk must be held.
+func (d *DB) cacheLoad() error {
+	if d.cacheFiles != nil {
+		return nil
+	}
+
+	files := make(map[string]*cacheFile)
+	var total int64
+
+	err := filepath.WalkDir(filepath.Join(d.path, d.name), func(fn string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !de.Type().IsRegular() || !strings.HasSuffix(fn, ".apkg") {
+			return nil
+		}
+		if f := statCacheFile(fn); f != nil {
+			files[fn] = f
+			total += f.usage
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.cacheFiles = files
+	d.cacheUsed = total
+	return nil
+}
+
+// statCacheFile returns the disk usage of a package file, or nil if it does
+// not exist.
+func statCacheFile(fn string) *cacheFile {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil
+	}
+	f := &cacheFile{path: fn, usage: diskUsage(fi), atime: fi.ModTime()}
+	if pi, err := os.Stat(fn + ".part"); err == nil {
+		f.usage += diskUsage(pi)
+	}
+	return f
+}
+
+// cacheUpdate records the current disk usage of a package file after it was
+// added, grew or was removed.
+func (d *DB) cacheUpdate(fn string) {
+	d = d.cacheRoot()
+	d.cacheStLk.Lock()
+	defer d.cacheStLk.Unlock()
+
+	if d.cacheFiles == nil {
+		// not scanned yet, the scan will include it
+		return
+	}
+	d.cacheUpdateLocked(fn)
+}
+
+func (d *DB) cacheUpdateLocked(fn string) {
+	if old, ok := d.cacheFiles[fn]; ok {
+		d.cacheUsed -= old.usage
+		delete(d.cacheFiles, fn)
+	}
+	if f := statCacheFile(fn); f != nil {
+		d.cacheFiles[fn] = f
+		d.cacheUsed += f.usage
+	}
+}
+
+// cacheAdd records a package file that was downloaded, and removes unused
+// packages if the cache is now over its limit.
+func (d *DB) cacheAdd(fn string) {
+	d.cacheUpdate(fn)
+	d.cacheCheck()
+}
+
+// cacheCheck removes unused packages if the cache is over its limit.
+func (d *DB) cacheCheck() {
+	d = d.cacheRoot()
+	limit := d.cacheLimit.Load()
+	if limit <= 0 {
+		return
+	}
+	d.cacheEvict(limit)
+}
+
+// cacheFree attempts to remove unused packages to free the given amount of
+// disk space.
+func (d *DB) cacheFree(n int64) {
+	d = d.cacheRoot()
+	usage, err := d.cacheScan()
+	if err != nil {
+		log.Printf("apkgdb: failed to scan cache: %s", err)
+		return
+	}
+	d.cacheEvict(usage - n)
+}
+
+// cacheEvict removes packages not in use, least recently used first, until
+// the cache uses no more than target bytes.
+func (d *DB) cacheEvict(target int64) {
+	if !d.cacheLk.TryLock() {
+		// already running
+		return
+	}
+	defer d.cacheLk.Unlock()
+
+	d.pkgCacheL.RLock()
+	loaded := maps.Clone(d.pkgPaths)
+	d.pkgCacheL.RUnlock()
+
+	d.cacheStLk.Lock()
+	if err := d.cacheLoad(); err != nil {
+		d.cacheStLk.Unlock()
+		log.Printf("apkgdb: failed to scan cache: %s", err)
+		return
+	}
+	// loaded packages grow as their blocks are downloaded
+	for fn := range loaded {
+		d.cacheUpdateLocked(fn)
+	}
+	usage := d.cacheUsed
+	var files []cacheFile
+	if usage > target {
+		files = make([]cacheFile, 0, len(d.cacheFiles))
+		for _, f := range d.cacheFiles {
+			files = append(files, *f)
+		}
+	}
+	d.cacheStLk.Unlock()
+
+	if usage <= target {
+		return
+	}
+
+	for i := range files {
+		f := &files[i]
+		if f.pkg = loaded[f.path]; f.pkg != nil {
+			if t := f.pkg.atime.Load(); t != 0 {
+				f.atime = time.Unix(0, t)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].atime.Before(files[j].atime) })
+
+	var freed int64
+	for _, f := range files {
+		if usage <= target {
+			break
+		}
+		if f.pkg != nil {
+			// scan the inodes in use before evict takes the write lock
+			if f.pkg.inUse() || !f.pkg.evict() {
+				continue
+			}
+		} else if !d.cacheRemove(f.path) {
+			continue
+		}
+		usage -= f.usage
+		freed += f.usage
+	}
+
+	log.Printf("apkgdb: freed %s from package cache, now using %s", formatSize(uint64(freed)), formatSize(uint64(max(usage, 0))))
+}
+
+// cacheRemove removes a package file that was not loaded when eviction
+// started, unless it got loaded since.
+func (d *DB) cacheRemove(fn string) bool {
+	d.pkgCacheL.RLock()
+	defer d.pkgCacheL.RUnlock()
+
+	if _, ok := d.pkgPaths[fn]; ok {
+		return false
+	}
+
+	removeCached(fn)
+	d.cacheUpdate(fn)
+	return true
+}
+
+// evict closes the package file and removes it from the disk, so it will be
+// downloaded again on next access. The caller must have checked the package
+// is not in use, see unload.
+func (p *Package) evict() bool {
+	// a lookup of the package may be the reason we are freeing space
+	if !p.parent.dbrw.TryLock() {
+		return false
+	}
+	defer p.parent.dbrw.Unlock()
+
+	if !p.dlMu.TryLock() {
+		// download in progress
+		return false
+	}
+	defer p.dlMu.Unlock()
+
+	if !p.unload() {
+		return false
+	}
+
+	removeCached(p.lpath())
+	p.parent.cacheUpdate(p.lpath())
+	log.Printf("apkgdb: evicted package %s from cache", p.name)
+	return true
+}
+
+func removeCached(fn string) {
+	os.Remove(fn + ".part")
+	os.Remove(fn + ".wpart")
+	os.Remove(fn)
+}
+
+func diskUsage(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// isNoSpace returns true if err means the disk is full
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// ParseSize parses a size such as "512M" or "10G" into a number of bytes.
+// Suffixes are binary (K = 1024), and a trailing "B" or "iB" is accepted.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	mul := int64(1)
+	if s != "" {
+		if p := strings.IndexByte("KMGTP", s[len(s)-1]); p != -1 {
+			mul = 1 << (10 * (p + 1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	v *= float64(mul)
+	if err != nil || !(v >= 0 && v < math.MaxInt64) {
+		return 0, errors.New("invalid size")
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,153 @@
+package apkgdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"512k", 512 * 1024},
+		{"10M", 10 * 1024 * 1024},
+		{"1.5G", 3 * 512 * 1024 * 1024},
+		{"2GiB", 2 * 1024 * 1024 * 1024},
+		{"1TB", 1024 * 1024 * 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		v, err := ParseSize(tt.input)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %s", tt.input, err)
+		} else if v != tt.expected {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.input, v, tt.expected)
+		}
+	}
+
+	for _, bad := range []string{"", "G", "-1M", "12X", "NaN", "inf"} {
+		if _, err := ParseSize(bad); err == nil {
+			t.Errorf("ParseSize(%q) should have failed", bad)
+		}
+	}
+}
+
+// testTracker reports a fixed set of inodes as in use
+type testTracker map[uint64]bool
+
+func (t testTracker) NotifyInode(ino uint64, offt int64, data []byte) error {
+	return nil
+}
+
+func (t testTracker) InodesInUse(start, end uint64) bool {
+	for ino := range t {
+		if ino >= start && ino <= end {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCacheFile(t *testing.T, fn string, size int, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Add(-age)
+	if err := os.Chtimes(fn, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	d := &DB{path: t.TempDir(), name: "test"}
+	d.SetNotifyTarget(testTracker{2001: true})
+	root := filepath.Join(d.path, d.name)
+
+	writeCacheFile(t, filepath.Join(root, "a/old.apkg"), 64*1024, 3*time.Hour)
+	writeCacheFile(t, filepath.Join(root, "a/old.apkg.part"), 16, 3*time.Hour)
+	writeCacheFile(t, filepath.Join(root, "b/busy.apkg"), 64*1024, 2*time.Hour)
+	writeCacheFile(t, filepath.Join(root, "b/looked.apkg"), 64*1024, 2*time.Hour)
+	writeCacheFile(t, filepath.Join(root, "b/mid.apkg"), 64*1024, time.Hour)
+	writeCacheFile(t, filepath.Join(root, "c/new.apkg"), 64*1024, 0)
+
+	// busy is loaded and one of its inodes is referenced
+	hashB := [32]byte{0xfe}
+	busy := &Package{parent: d, name: "busy", path: "b/busy.apkg", hash: hashB[:], startIno: 2000, inodes: 10}
+	// looked was just returned by a lookup, the kernel may not reference it yet
+	hashL := [32]byte{0xfd}
+	looked := &Package{parent: d, name: "looked", path: "b/looked.apkg", hash: hashL[:], startIno: 3000, inodes: 10}
+	looked.looked.Store(time.Now().UnixNano())
+	d.pkgCache = map[pkgKey]*Package{{d, hashB}: busy, {d, hashL}: looked}
+	d.pkgPaths = map[string]*Package{busy.lpath(): busy, looked.lpath(): looked}
+
+	usage, err := d.cacheScan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old and mid need to go, busy and looked are older than mid but must be kept
+	d.cacheEvict(usage - 100*1024)
+
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(root, p))
+		return err == nil
+	}
+
+	if exists("a/old.apkg") || exists("a/old.apkg.part") {
+		t.Errorf("least recently used package should have been evicted")
+	}
+	if exists("b/mid.apkg") {
+		t.Errorf("second least recently used package should have been evicted")
+	}
+	if !exists("b/busy.apkg") {
+		t.Errorf("package in use should have been kept")
+	}
+	if !exists("b/looked.apkg") {
+		t.Errorf("package looked up recently should have been kept")
+	}
+	if !exists("c/new.apkg") {
+		t.Errorf("recent package should have been kept")
+	}
+}
+
+func TestCacheUsageTracked(t *testing.T) {
+	d := &DB{path: t.TempDir(), name: "test"}
+	root := filepath.Join(d.path, d.name)
+
+	writeCacheFile(t, filepath.Join(root, "a/old.apkg"), 64*1024, time.Hour)
+	if _, _, err := d.CacheUsage(); err == nil {
+		t.Errorf("usage should not be known before the cache was scanned")
+	}
+	before, err := d.cacheScan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory is only scanned once, later files are recorded as added
+	fn := filepath.Join(root, "b/new.apkg")
+	writeCacheFile(t, fn, 64*1024, 0)
+	if usage, _, _ := d.CacheUsage(); usage != before {
+		t.Errorf("usage changed without update: %d != %d", usage, before)
+	}
+	d.cacheUpdate(fn)
+	added, _, _ := d.CacheUsage()
+	if added <= before {
+		t.Errorf("usage did not grow after update: %d <= %d", added, before)
+	}
+
+	if !d.cacheRemove(fn) {
+		t.Fatalf("failed to remove unloaded package file")
+	}
+	if usage, _, _ := d.CacheUsage(); usage != before {
+		t.Errorf("usage after removal = %d, want %d", usage, before)
+	}
+}
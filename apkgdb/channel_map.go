@@ -0,0 +1,176 @@
+package apkgdb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/AzusaOS/apkg/apkgfs"
+)
+
+// ChannelRule selects the release channel used to resolve lookups made by
+// processes running as a given uid, or inside a given cgroup.
+type ChannelRule struct {
+	Uid     int    `json:"uid"`              // -1 to match any uid
+	Cgroup  string `json:"cgroup,omitempty"` // cgroup v2 path, matches its children too
+	Channel string `json:"channel"`
+}
+
+func (r *ChannelRule) match(uid int, cgroup func() string) bool {
+	if r.Uid != -1 && r.Uid != uid {
+		return false
+	}
+	if r.Cgroup != "" {
+		cg := cgroup()
+		return cg == r.Cgroup || strings.HasPrefix(cg, strings.TrimSuffix(r.Cgroup, "/")+"/")
+	}
+	return true
+}
+
+// LoadChannelMap reads a channel map file. Each line is a rule, the first
+// matching rule gives the channel of the caller:
+//
+//	# CI jobs run against testing
+//	uid ci testing
+//	cgroup /system.slice/gitlab-runner.service testing
+//
+// Users can be given by name or numeric uid. A missing file is not an error
+// and returns no rules.
+func LoadChannelMap(fn string) ([]ChannelRule, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []ChannelRule
+	s := bufio.NewScanner(f)
+	ln := 0
+	for s.Scan() {
+		ln += 1
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected uid or cgroup, value and channel", fn, ln)
+		}
+
+		r := ChannelRule{Uid: -1, Channel: fields[2]}
+		switch fields[0] {
+		case "uid":
+			uid, err := lookupUid(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", fn, ln, err)
+			}
+			r.Uid = uid
+		case "cgroup":
+			if !strings.HasPrefix(fields[1], "/") {
+				return nil, fmt.Errorf("%s:%d: cgroup path must be absolute", fn, ln)
+			}
+			r.Cgroup = fields[1]
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule %s", fn, ln, fields[0])
+		}
+		res = append(res, r)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func lookupUid(s string) (int, error) {
+	if uid, err := strconv.Atoi(s); err == nil && uid >= 0 {
+		return uid, nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// SetChannelMap sets the rules selecting the channel from the caller of a
+// lookup, for the database and its sub databases. Callers matching no rule
+// use the channel set by SetChannel.
+func (d *DB) SetChannelMap(rules []ChannelRule) {
+	if len(rules) == 0 {
+		rules = nil
+	}
+	d.channelMap.Store(&rules)
+	d.subLk.RLock()
+	for _, sub := range d.sub {
+		sub.SetChannelMap(rules)
+	}
+	d.subLk.RUnlock()
+}
+
+// ChannelMap returns the rules set by SetChannelMap.
+func (d *DB) ChannelMap() []ChannelRule {
+	if p := d.channelMap.Load(); p != nil {
+		return append([]ChannelRule{}, *p...)
+	}
+	return nil
+}
+
+// channelFor returns the channel to use for a lookup made with ctx. When
+// rules are set, the result of the lookup is marked as volatile so the
+// kernel does not share it between callers.
+func (d *DB) channelFor(ctx context.Context) string {
+	p := d.channelMap.Load()
+	if p == nil || len(*p) == 0 {
+		return d.channel
+	}
+	apkgfs.SetVolatile(ctx)
+
+	uid := -1
+	if v, ok := ctx.Value(apkgfs.Uid).(uint32); ok {
+		uid = int(v)
+	}
+	var cg *string
+	cgroup := func() string {
+		// only read when a cgroup rule is reached
+		if cg == nil {
+			var s string
+			if pid, ok := ctx.Value(apkgfs.Pid).(uint32); ok {
+				s = processCgroup(pid)
+			}
+			cg = &s
+		}
+		return *cg
+	}
+
+	for i := range *p {
+		if r := &(*p)[i]; r.match(uid, cgroup) {
+			return r.Channel
+		}
+	}
+	return d.channel
+}
+
+// processCgroup returns the cgroup v2 path of a process, or "" if unknown
+func processCgroup(pid uint32) string {
+	if pid == 0 {
+		return ""
+	}
+	buf, err := os.ReadFile("/proc/" + strconv.FormatUint(uint64(pid), 10) + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		// unified hierarchy: "0::/path"
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return p
+		}
+	}
+	return ""
+}
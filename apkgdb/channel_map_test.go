@@ -0,0 +1,93 @@
+package apkgdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AzusaOS/apkg/apkgfs"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLoadChannelMap(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "channels.conf")
+	os.WriteFile(fn, []byte("# CI\nuid 1001 testing\ncgroup /system.slice/ci.service testing # runner\n\nuid 0 latest\n"), 0644)
+
+	rules, err := LoadChannelMap(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChannelRule{
+		{Uid: 1001, Channel: "testing"},
+		{Uid: -1, Cgroup: "/system.slice/ci.service", Channel: "testing"},
+		{Uid: 0, Channel: "latest"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d: expected %+v, got %+v", i, want[i], rules[i])
+		}
+	}
+
+	for _, bad := range []string{"uid 1001\n", "gid 10 testing\n", "cgroup ci.service testing\n"} {
+		os.WriteFile(fn, []byte(bad), 0644)
+		if _, err := LoadChannelMap(fn); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestChannelRuleMatch(t *testing.T) {
+	cgroup := func() string { return "/system.slice/ci.service/job-12" }
+
+	r := &ChannelRule{Uid: -1, Cgroup: "/system.slice/ci.service", Channel: "testing"}
+	if !r.match(1000, cgroup) {
+		t.Error("cgroup rule should match child cgroups")
+	}
+	r.Cgroup = "/system.slice/ci"
+	if r.match(1000, cgroup) {
+		t.Error("cgroup rule should not match on a partial name")
+	}
+	r = &ChannelRule{Uid: 1001, Channel: "testing"}
+	if r.match(1000, cgroup) || !r.match(1001, cgroup) {
+		t.Error("uid rule mismatch")
+	}
+}
+
+func TestChannelForCaller(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.40.linux.amd64", "sys-libs.glibc.libs.2.41.linux.amd64")
+	d.SetPin("stable", "sys-libs.glibc.libs", "2.40")
+	d.SetChannel("stable")
+	d.SetChannelMap([]ChannelRule{{Uid: 1001, Channel: "latest"}})
+
+	resolve := func(uid uint32) string {
+		ctx := context.WithValue(context.Background(), apkgfs.Uid, uid)
+		ch := d.channelFor(ctx)
+
+		d.dbrw.RLock()
+		defer d.dbrw.RUnlock()
+
+		var res string
+		d.dbptr.View(func(tx *bolt.Tx) error {
+			if v, _, err := d.resolveTx(tx, ch, "sys-libs.glibc.libs"); err == nil {
+				res = string(v[32+8:])
+			}
+			return nil
+		})
+		return res
+	}
+
+	if v := resolve(1000); v != "sys-libs.glibc.libs.2.40.linux.amd64" {
+		t.Errorf("uid 1000 should follow stable, got %s", v)
+	}
+	if v := resolve(1001); v != "sys-libs.glibc.libs.2.41.linux.amd64" {
+		t.Errorf("uid 1001 should follow latest, got %s", v)
+	}
+
+}
@@ -0,0 +1,176 @@
+package apkgdb
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Lookups can restrict the version of a package with a list of comma
+// separated conditions after a "@", all of which must match:
+//
+//	dev-lang.python.core@>=3.11,<3.13
+//	dev-lang.python.core@~3.12
+//
+// Supported operators are >=, >, <=, <, = (version or any of its
+// sub-versions, also used when no operator is given), != and ~ (~3.12 is
+// >=3.12,<3.13 and ~3 is >=3,<4). Versions are compared with the same
+// collation as package names, so 3.9 < 3.12.
+
+// badConstraint returns the error for an invalid version constraint. It
+// wraps os.ErrInvalid so lookups fail with EINVAL.
+func badConstraint(s string) error {
+	return &os.PathError{Op: "parse version constraint", Path: s, Err: os.ErrInvalid}
+}
+
+type versionCond struct {
+	op  string
+	raw string
+	v   []byte // collated version
+}
+
+// versionConstraint is a list of conditions on a version
+type versionConstraint []versionCond
+
+func parseConstraint(s string) (versionConstraint, error) {
+	var res versionConstraint
+
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		op := "="
+		for _, o := range []string{">=", "<=", "!=", "==", ">", "<", "=", "~"} {
+			if strings.HasPrefix(c, o) {
+				op = o
+				c = strings.TrimSpace(c[len(o):])
+				break
+			}
+		}
+		if op == "==" {
+			op = "="
+		}
+		if c == "" || strings.ContainsAny(c, "@/ \x00") {
+			return nil, badConstraint(s)
+		}
+
+		if op == "~" {
+			upper, ok := tildeUpper(c)
+			if !ok {
+				return nil, badConstraint(s)
+			}
+			res = append(res, versionCond{op: ">=", raw: c, v: collatedVersion(c)}, versionCond{op: "<", raw: upper, v: collatedVersion(upper)})
+			continue
+		}
+		res = append(res, versionCond{op: op, raw: c, v: collatedVersion(c)})
+	}
+	return res, nil
+}
+
+// tildeUpper returns the exclusive upper bound for ~v
+func tildeUpper(v string) (string, bool) {
+	parts := strings.Split(v, ".")
+	n := 0
+	if len(parts) > 1 {
+		n = 1
+	}
+	i, err := strconv.ParseUint(parts[n], 10, 32)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join(append(parts[:n:n], strconv.FormatUint(i+1, 10)), "."), true
+}
+
+// match returns true if version satisfies all the conditions
+func (c versionConstraint) match(version string) bool {
+	cv := collatedVersion(version)
+
+	for _, cond := range c {
+		cmp := bytes.Compare(cv, cond.v)
+		var ok bool
+		switch cond.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "=":
+			ok = version == cond.raw || strings.HasPrefix(version, cond.raw+".")
+		case "!=":
+			ok = version != cond.raw && !strings.HasPrefix(version, cond.raw+".")
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// packageVersion extracts the version from the full name of a package
+// belonging to family, for example 3.12.1 from
+// dev-lang.python.core.3.12.1.linux.amd64.
+func packageVersion(family, full string) (string, bool) {
+	if !strings.HasPrefix(full, family+".") {
+		return "", false
+	}
+	v := full[len(family)+1:]
+
+	// remove os & arch
+	for i := 0; i < 2; i++ {
+		p := strings.LastIndexByte(v, '.')
+		if p == -1 {
+			return "", false
+		}
+		v = v[:p]
+	}
+
+	if v == "" || v[0] < '0' || v[0] > '9' {
+		// not a version, name is the prefix of another package
+		return "", false
+	}
+	return v, true
+}
+
+// resolveConstraintTx finds the latest version of family matching the
+// constraint expression. If channel ch pins family to a version matching
+// the constraint, the pinned version is preferred. Must be called within a
+// bolt View transaction with the read lock held.
+func (i *DB) resolveConstraintTx(tx *bolt.Tx, ch, family, expr string) ([]byte, error) {
+	c, err := parseConstraint(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := tx.Bucket([]byte("p2p"))
+	if b == nil {
+		return nil, os.ErrNotExist
+	}
+
+	pin := i.lookupPinTx(tx, ch, family)
+	prefix := collatedVersion(family + ".")
+
+	var best []byte
+	cur := b.Cursor()
+	cur.Seek(append(prefix, 0xff))
+	for k, v := cur.Prev(); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Prev() {
+		version, ok := packageVersion(family, string(v[32+8:]))
+		if !ok || !c.match(version) {
+			continue
+		}
+		if pin == "" || version == pin || strings.HasPrefix(version, pin+".") {
+			return v, nil
+		}
+		if best == nil {
+			best = v
+		}
+	}
+
+	if best == nil {
+		return nil, os.ErrNotExist
+	}
+	return best, nil
+}
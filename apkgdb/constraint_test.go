@@ -0,0 +1,113 @@
+package apkgdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		expr    string
+		version string
+		match   bool
+	}{
+		{">=3.11,<3.13", "3.11", true},
+		{">=3.11,<3.13", "3.12.1", true},
+		{">=3.11,<3.13", "3.9.7", false},
+		{">=3.11,<3.13", "3.13.0", false},
+		{">=3.11,<3.13", "3.13", false},
+		{"~3.12", "3.12", true},
+		{"~3.12", "3.12.8", true},
+		{"~3.12", "3.13.0", false},
+		{"~3.12", "3.11.2", false},
+		{"~3.12.2", "3.12.1", false},
+		{"~3.12.2", "3.12.10", true},
+		{"~3", "3.99", true},
+		{"~3", "4.0", false},
+		{"3.12", "3.12.1", true},
+		{"=3.12", "3.120", false},
+		{"==3.12.1", "3.12.1", true},
+		{"!=3.12", "3.12.1", false},
+		{"!=3.12", "3.11", true},
+		{">2.4.9", "2.4.10", true},
+		{"<=2.4.9", "2.4.10", false},
+	}
+
+	for _, tt := range tests {
+		c, err := parseConstraint(tt.expr)
+		if err != nil {
+			t.Errorf("parseConstraint(%q) failed: %s", tt.expr, err)
+			continue
+		}
+		if m := c.match(tt.version); m != tt.match {
+			t.Errorf("%q match %q = %v, want %v", tt.expr, tt.version, m, tt.match)
+		}
+	}
+
+	for _, bad := range []string{"", ">=", "3.12,", "~x.y", "~3.x", ">=3/4"} {
+		if _, err := parseConstraint(bad); err == nil {
+			t.Errorf("parseConstraint(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestConstraintLookup(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	addTestPackages(t, d, `{}`,
+		"dev-lang.python.core.3.9.18.linux.amd64",
+		"dev-lang.python.core.3.11.8.linux.amd64",
+		"dev-lang.python.core.3.12.1.linux.amd64",
+		"dev-lang.python.core.3.12.2.linux.amd64",
+		"dev-lang.python.core.3.13.0.linux.amd64",
+		"dev-lang.python.core.extra.1.0.linux.amd64",
+	)
+
+	resolve := func(name string) string {
+		var res string
+		err := d.dbptr.View(func(tx *bolt.Tx) error {
+			v, _, err := d.resolveTx(tx, d.channel, name)
+			if err == nil {
+				res = string(v[32+8:])
+			}
+			return err
+		})
+		if err != nil && err != os.ErrNotExist {
+			t.Errorf("resolve %q failed: %s", name, err)
+		}
+		return res
+	}
+
+	d.channel = "stable"
+	tests := map[string]string{
+		"dev-lang.python.core@>=3.11,<3.13": "dev-lang.python.core.3.12.2.linux.amd64",
+		"dev-lang.python.core@~3.11":        "dev-lang.python.core.3.11.8.linux.amd64",
+		"dev-lang.python.core@<3.10":        "dev-lang.python.core.3.9.18.linux.amd64",
+		"dev-lang.python.core@3.12.1":       "dev-lang.python.core.3.12.1.linux.amd64",
+		"dev-lang.python.core@>=1":          "dev-lang.python.core.3.13.0.linux.amd64",
+		"dev-lang.python.core@>=4":          "",
+		"dev-lang.python@>=1":               "",
+	}
+	for name, expected := range tests {
+		if v := resolve(name); v != expected {
+			t.Errorf("resolve(%q) = %q, want %q", name, v, expected)
+		}
+	}
+
+	// a pin matching the constraint is preferred, otherwise it is ignored
+	d.SetPin("stable", "dev-lang.python.core", "3.12.1")
+	if v := resolve("dev-lang.python.core@~3.12"); v != "dev-lang.python.core.3.12.1.linux.amd64" {
+		t.Errorf("expected pinned version, got %q", v)
+	}
+	if v := resolve("dev-lang.python.core@>=3.13"); v != "dev-lang.python.core.3.13.0.linux.amd64" {
+		t.Errorf("expected pin outside of constraint to be ignored, got %q", v)
+	}
+
+	if _, err := d.internalLookup("dev-lang.python.core@~x"); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("expected os.ErrInvalid, got %v", err)
+	}
+}
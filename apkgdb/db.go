@@ -9,7 +9,9 @@ import (
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/KarpelesLab/ldcache"
 	"github.com/petar/GoLLRB/llrb"
 	bolt "go.etcd.io/bbolt"
 )
@@ -18,22 +20,26 @@ import (
 var ErrDatabaseClosed = errors.New("database is closed")
 
 // PKG_URL_PREFIX is the default URL prefix for downloading packages and databases.
+// A comma separated list of prefixes can be passed to New instead, in which
+// case they are used as mirrors and tried in order.
 const PKG_URL_PREFIX = "https://data.apkg.net/"
 
 // DB represents a package database that manages package metadata, lookups,
 // and inode allocation for the FUSE filesystem. It uses BoltDB for persistent
 // storage and supports multiple OS/architecture combinations through sub-databases.
 type DB struct {
-	prefix string
-	path   string
-	name   string
-	os     string
-	arch   string
-	dbptr  *bolt.DB
-	upd    chan struct{}
-	done   chan struct{}
+	prefix  string
+	mirrors *mirrorList
+	path    string
+	name    string
+	os      string
+	arch    string
+	dbptr   *bolt.DB
+	upd     chan struct{}
+	done    chan struct{}
 
 	ino    *llrb.LLRB
+	inoLk  sync.RWMutex // protects ino
 	refcnt uint64
 	dbrw   sync.RWMutex
 	parent *DB // if this is called from another db
@@ -43,18 +49,69 @@ type DB struct {
 
 	nextIlk sync.RWMutex
 	nextI   uint64 // next unallocated inode #
+	inoBase uint64 // first inode # of the database, see SetInodeBase
 	pkgIlk  sync.RWMutex
 	pkgI    map[[32]byte]uint64 // maps package hash → initial inode number
 	sub     map[ArchOS]*DB
 	subLk   sync.RWMutex
-	ntgt    atomic.Value // stores NotifyTarget
+	ntgt    atomic.Value // stores notifyTargets
+	ntgtLk  sync.Mutex
 	ldso    []byte
+	ldsoEnt map[string]*ldcache.Entry // content of ldso by library name
+	ldsoLk  sync.Mutex
 	channel string // release channel for version resolution ("latest" = no pins)
+
+	overrides  atomic.Pointer[map[string]string] // local pins, prefix → version
+	channelMap atomic.Pointer[[]ChannelRule]     // per caller channel selection
+
+	maxAgeWarn   time.Duration // warn if database is older than this
+	maxAgeRefuse time.Duration // refuse updates signed longer ago than this
+	signers      []string      // names of the keys trusted for this database, nil = all
+
+	cacheLimit atomic.Int64          // max disk usage of downloaded packages, 0 = no limit
+	cacheLk    sync.Mutex            // held while evicting
+	cacheFiles map[string]*cacheFile // package files on disk by path, nil until scanned, only on the root
+	cacheUsed  int64                 // total disk usage of cacheFiles
+	cacheStLk  sync.Mutex
+
+	pkgCache  map[pkgKey]*Package // loaded packages of the database and its sub databases, only on the root
+	pkgPaths  map[string]*Package // loaded packages by local file path, only on the root
+	pkgCacheL sync.RWMutex
+
+	virtual *virtualView // current content of .virtual, nil if needs to be built
+	virtLk  sync.Mutex
+
+	listShort atomic.Bool // list names without version in the root directory
+	rootDirs  dirHandles  // names listed in the root directory, per open handle
+
+	keepExports int // full exports kept to generate deltas from
+
+	prefetchLk   sync.Mutex
+	prefetchJobs []*prefetchJob // recent jobs, oldest first
+	prefetchID   int            // id of the last job
+
+	prefetchNeeded atomic.Bool // prefetch the packages providing needed libraries
 }
 
 // New creates a new package database using the current system's OS and architecture.
 // It opens or creates a BoltDB database file at the specified path.
 func New(prefix, name, path string) (*DB, error) {
+	goos, goarch := hostOsArch()
+	return NewOsArch(prefix, name, path, goos, goarch)
+}
+
+// NewExport opens a database for ExportBundle using the current system's OS
+// and architecture. Unlike New, it neither downloads the database nor checks
+// for updates: ExportBundle downloads the database once, indexes it and
+// includes the same file in the bundle.
+func NewExport(prefix, name, path string) (*DB, error) {
+	goos, goarch := hostOsArch()
+	return newOsArch(prefix, name, path, goos, goarch, false)
+}
+
+// hostOsArch returns the current system's OS and architecture, which can be
+// overridden with the GOOS and GOARCH environment variables.
+func hostOsArch() (string, string) {
 	goos := runtime.GOOS
 	goarch := runtime.GOARCH
 
@@ -64,13 +121,18 @@ func New(prefix, name, path string) (*DB, error) {
 	if val := os.Getenv("GOARCH"); val != "" {
 		goarch = val
 	}
-
-	return NewOsArch(prefix, name, path, goos, goarch)
+	return goos, goarch
 }
 
 // NewOsArch creates a new package database for a specific OS and architecture.
 // This is used both for the primary database and for cross-architecture sub-databases.
 func NewOsArch(prefix, name, path, dbos, dbarch string) (*DB, error) {
+	return newOsArch(prefix, name, path, dbos, dbarch, true)
+}
+
+// newOsArch opens the database, and if update is true downloads it if empty
+// and keeps it up to date.
+func newOsArch(prefix, name, path, dbos, dbarch string, update bool) (*DB, error) {
 	_ = os.MkdirAll(path, 0755) // make sure dir exists
 	fn := filepath.Join(path, name+"."+dbos+"."+dbarch+".db")
 
@@ -88,27 +150,34 @@ func NewOsArch(prefix, name, path, dbos, dbarch string) (*DB, error) {
 	}
 
 	res := &DB{
-		dbptr:  db,
-		prefix: prefix,
-		path:   path,
-		name:   name,
-		os:     dbos,
-		osV:    ParseOS(dbos),
-		arch:   dbarch,
-		archV:  ParseArch(dbarch),
-		ino:    llrb.New(),
-		pkgI:   make(map[[32]byte]uint64),
-		nextI:  1000, // 1=root, 2=ld.so.cache
-		upd:    make(chan struct{}),
-		done:   make(chan struct{}),
-		sub:    make(map[ArchOS]*DB),
+		dbptr:   db,
+		prefix:  prefix,
+		mirrors: parseMirrors(prefix),
+		path:    path,
+		name:    name,
+		os:      dbos,
+		osV:     ParseOS(dbos),
+		arch:    dbarch,
+		archV:   ParseArch(dbarch),
+		ino:     llrb.New(),
+		pkgI:    make(map[[32]byte]uint64),
+		nextI:   1000, // 1=root, 2=ld.so.cache, 3=.virtual
+		upd:     make(chan struct{}),
+		done:    make(chan struct{}),
+		sub:     make(map[ArchOS]*DB),
+
+		maxAgeWarn: DefaultMaxAgeWarn,
 	}
 
 	_ = res.buildLdso()
 
+	if !update {
+		return res, nil
+	}
+
 	updateReq := true
 
-	if res.CurrentVersion() == "" {
+	if res.CurrentVersion() == "" && res.mirrors.best() != nil {
 		// need to perform download now
 		_, err = res.download("")
 		if err != nil {
@@ -126,6 +195,7 @@ func NewOsArch(prefix, name, path, dbos, dbarch string) (*DB, error) {
 // Use "latest" to always resolve to the newest version (no pins).
 func (d *DB) SetChannel(ch string) {
 	d.channel = ch
+	d.resetVirtual()
 	d.subLk.RLock()
 	for _, sub := range d.sub {
 		sub.channel = ch
@@ -133,6 +203,30 @@ func (d *DB) SetChannel(ch string) {
 	d.subLk.RUnlock()
 }
 
+// SetInodeBase makes the database allocate inode numbers from base, so
+// databases merged by Layers never share inode numbers. It must be called
+// before the database is used.
+func (d *DB) SetInodeBase(base uint64) {
+	d.nextIlk.Lock()
+	defer d.nextIlk.Unlock()
+
+	d.inoBase = base
+	d.nextI = base + 1000 // 1=root, 2=ld.so.cache, 3=.virtual
+}
+
+// SetSigners limits the keys trusted to sign the database and its packages
+// to the trusted keys (compiled-in or from the local trust store) with one of
+// the given names. An empty list trusts all keys. It must be called before
+// the database is used.
+func (d *DB) SetSigners(names []string) {
+	d.signers = names
+	d.subLk.RLock()
+	for _, sub := range d.sub {
+		sub.signers = names
+	}
+	d.subLk.RUnlock()
+}
+
 // CurrentVersion returns the version string of the currently loaded database,
 // or an empty string if no version is set.
 func (d *DB) CurrentVersion() (v string) {
@@ -0,0 +1,149 @@
+package apkgdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgsig"
+	"github.com/KarpelesLab/hsm"
+)
+
+// Clients that already have a database ask mirrors for <old>-<new>.bin
+// before downloading the full <new>.bin. A delta is a regular database file
+// flagged with dbFlagDelta that only lists the packages added since <old>,
+// followed by all the pins and revocations, so index() applies it on top of
+// the existing database like a full file. The signed header of a delta holds
+// <old> in place of the id index location, and index() refuses the delta
+// unless the current version is <old>.
+
+// dbFlagDelta marks a database file as a delta, which can only be applied
+// on top of an existing database.
+const dbFlagDelta = 1
+
+var exportFileRe = regexp.MustCompile(`^[0-9]{14}\.bin$`)
+
+// SetKeepExports sets the number of full exports kept in the database
+// directory, older ones are removed. Each export also generates deltas from
+// the previous n-1 exports. Zero (the default) keeps all the exports and
+// generates no delta.
+func (d *DB) SetKeepExports(n int) {
+	d.keepExports = n
+}
+
+// previousExports returns the full exports found in the database directory,
+// oldest first.
+func (d *DB) previousExports() ([]string, error) {
+	ents, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, e := range ents {
+		if e.Type().IsRegular() && exportFileRe.MatchString(e.Name()) {
+			res = append(res, strings.TrimSuffix(e.Name(), ".bin"))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// exportDeltas generates deltas from the most recent previous exports to
+// version, removes exports and deltas that are no longer needed, and returns
+// the delta files created.
+func (d *DB) exportDeltas(prev []string, version string, now time.Time, keys []hsm.Key) ([]string, error) {
+	if d.keepExports <= 0 {
+		// exports are not managed
+		return nil, nil
+	}
+	keep := d.keepExports - 1
+	if len(prev) > keep {
+		for _, v := range prev[:len(prev)-keep] {
+			os.Remove(filepath.Join(d.path, v+".bin"))
+		}
+		prev = prev[len(prev)-keep:]
+	}
+
+	// deltas to older versions were published already
+	if old, err := filepath.Glob(filepath.Join(d.path, "*-*.bin")); err == nil {
+		for _, fn := range old {
+			os.Remove(fn)
+		}
+	}
+
+	var res []string
+	for _, v := range prev {
+		if v >= version {
+			continue
+		}
+		baseV, err := time.Parse(versionFormat, v)
+		if err != nil {
+			log.Printf("apkgdb: skipping delta from %s: %s", v, err)
+			continue
+		}
+		base, err := exportHashes(filepath.Join(d.path, v+".bin"))
+		if err != nil {
+			log.Printf("apkgdb: skipping delta from %s: %s", v, err)
+			continue
+		}
+		fn := filepath.Join(d.path, v+"-"+version+".bin")
+		if err := d.writeExport(fn, now, keys, base, baseV); err != nil {
+			return nil, fmt.Errorf("delta from %s: %w", v, err)
+		}
+		res = append(res, fn)
+	}
+	return res, nil
+}
+
+// exportHashes returns the hashes of the packages in a database file.
+func exportHashes(fn string) (map[string]bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 196)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "APDB" {
+		return nil, errors.New("not a apkgdb file")
+	}
+	count := binary.BigEndian.Uint32(header[40:44])
+	dataLoc := binary.BigEndian.Uint32(header[76:80])
+
+	if _, err := f.Seek(int64(dataLoc), io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+
+	res := make(map[string]bool)
+	entry := make([]byte, 1+32+8+4) // type, hash, size, inodes
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, err
+		}
+		if entry[0] != 0 {
+			return nil, fmt.Errorf("invalid package type %d", entry[0])
+		}
+		res[string(entry[1:33])] = true
+
+		// name, path, header, signature, metadata
+		for _, max := range []uint64{256, 256, 256, apkgsig.SignatureSize, 1024 * 1024} {
+			if _, err := apkgsig.ReadVarblob(r, max); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
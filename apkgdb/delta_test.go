@@ -0,0 +1,155 @@
+package apkgdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgsig"
+	"github.com/KarpelesLab/hsm"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestExportDelta(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	key := newTestExportKey(t)
+
+	d.SetKeepExports(2)
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.41.linux.amd64")
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	v1 := d.CurrentVersion()
+
+	// versions have a one second resolution
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	// the database is read-only between writes
+	if err := d.writeStart(); err != nil {
+		t.Fatal(err)
+	}
+	addTestPackages(t, d, `{}`, "dev-lang.python.core.3.12.1.linux.amd64")
+	d.writeEnd()
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	v2 := d.CurrentVersion()
+
+	delta := filepath.Join(d.path, v1+"-"+v2+".bin")
+	hashes, err := exportHashes(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 {
+		t.Errorf("expected 1 package in delta, got %d", len(hashes))
+	}
+
+	// a delta cannot be used as a full database
+	d2, cleanup2 := newTestDB(t)
+	defer cleanup2()
+	if err := indexTestFile(d2, delta); err == nil || !strings.Contains(err.Error(), "existing database") {
+		t.Errorf("expected delta to be refused on an empty database, got %v", err)
+	}
+
+	// but applies on top of the previous version
+	if err := indexTestFile(d2, filepath.Join(d.path, v1+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexTestFile(d2, delta); err != nil {
+		t.Fatal(err)
+	}
+	if d2.CurrentVersion() != v2 {
+		t.Errorf("expected version %s after delta, got %s", v2, d2.CurrentVersion())
+	}
+	if _, err := d2.internalLookup("dev-lang.python.core.3.12.1.linux.amd64"); err != nil {
+		t.Errorf("package from delta not found: %s", err)
+	}
+
+	// a third export only keeps the previous one
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	exports, _ := d.previousExports()
+	if len(exports) != 2 || exports[0] != v2 {
+		t.Errorf("unexpected exports kept %v", exports)
+	}
+	if _, err := os.Stat(delta); !os.IsNotExist(err) {
+		t.Errorf("old delta should have been removed")
+	}
+}
+
+func TestExportDeltaBase(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	key := newTestExportKey(t)
+
+	d.SetKeepExports(3)
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.41.linux.amd64")
+	var versions []string
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			// versions have a one second resolution
+			time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+		}
+		if err := d.Export(nil, key); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, d.CurrentVersion())
+	}
+	v1, v2, v3 := versions[0], versions[1], versions[2]
+
+	d2, cleanup2 := newTestDB(t)
+	defer cleanup2()
+	if err := indexTestFile(d2, filepath.Join(d.path, v1+".bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delta from v2 does not apply on top of v1
+	err := indexTestFile(d2, filepath.Join(d.path, v2+"-"+v3+".bin"))
+	if err == nil || !strings.Contains(err.Error(), "cannot be applied to version "+v1) {
+		t.Errorf("expected delta from %s to be refused on %s, got %v", v2, v1, err)
+	}
+	if d2.CurrentVersion() != v1 {
+		t.Errorf("refused delta changed the version to %s", d2.CurrentVersion())
+	}
+
+	// while the one from v1 does
+	if err := indexTestFile(d2, filepath.Join(d.path, v1+"-"+v3+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if d2.CurrentVersion() != v3 {
+		t.Errorf("expected version %s after delta, got %s", v3, d2.CurrentVersion())
+	}
+}
+
+// newTestExportKey returns a key trusted to sign databases until the end of
+// the test.
+func newTestExportKey(t *testing.T) hsm.Key {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustDir := t.TempDir()
+	os.WriteFile(filepath.Join(trustDir, "test.json"), []byte(`{"key":"`+base64.RawURLEncoding.EncodeToString(pub)+`","scope":"db"}`), 0644)
+	if err := apkgsig.LoadTrustDir(trustDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { apkgsig.LoadTrustDir(t.TempDir()) })
+	return apkgsig.NewKey(priv, "test")
+}
+
+func indexTestFile(d *DB, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.index(f)
+}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"sync"
@@ -24,10 +23,17 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-// ExportAndUpload exports the database to a binary file, signs it,
-// and uploads it to the configured S3 bucket.
-func (d *DB) ExportAndUpload(k hsm.Key) error {
+// Export exports the database to a binary file in the database directory,
+// signs it, and publishes it with pub. If pub is nil the files are only
+// written locally. When several keys are given, the database carries a
+// signature from each of them, and LATEST.jwt is signed with the first one
+// only: the signature threshold of clients does not apply to it.
+func (d *DB) Export(pub Publisher, keys ...hsm.Key) error {
 	// generate a binary file with the full db, and upload it
+	if len(keys) == 0 {
+		return errors.New("no signing key")
+	}
+	k := keys[0]
 
 	now := time.Now()
 	stamp := now.UTC().Format("20060102150405")
@@ -36,6 +42,114 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 
 	log.Printf("apkgdb: creating database export version %s", stamp)
 
+	// previous exports, to generate deltas from
+	prev, err := d.previousExports()
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeExport(fn, now, keys, nil, time.Time{}); err != nil {
+		return err
+	}
+
+	// call index on file to check if the generated file is 100% valid
+	f, err := os.Open(fn)
+	if err != nil {
+		return err // ???
+	}
+
+	err = d.index(f)
+	f.Close()
+	if err != nil {
+		return err // failed to index: must be an error in file creation
+	}
+
+	deltas, err := d.exportDeltas(prev, stamp, now, keys)
+	if err != nil {
+		return err
+	}
+
+	// Generate LATEST.txt
+	lat, err := os.Create(path.Join(d.path, "LATEST.txt"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(lat, "%s\n", stamp)
+	if err := lat.Close(); err != nil {
+		return err
+	}
+
+	// generate LATEST.jwt
+	sig_pub, err := k.PublicBlob()
+	if err != nil {
+		return err
+	}
+
+	lat, err = os.Create(path.Join(d.path, "LATEST.jwt"))
+	if err != nil {
+		return err
+	}
+	token := jwt.New(jwt.EdDSA)
+	for k, v := range map[string]string{"ver": stamp, "arch": d.arch, "os": d.os, "name": d.name} {
+		if err = token.Payload().Set(k, v); err != nil {
+			return err
+		}
+	}
+	if err = token.Payload().Set("iat", now.Unix()); err != nil {
+		return err
+	}
+	if err = token.Header().Set("kid", base64.RawURLEncoding.EncodeToString(sig_pub)); err != nil {
+		return err
+	}
+	tokenString, err := token.Sign(rand.Reader, k)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(lat, "%s\n", tokenString)
+	if err := lat.Close(); err != nil {
+		return err
+	}
+
+	if pub == nil {
+		log.Printf("apkgdb: exported database version %s to %s, not publishing", stamp, d.path)
+		return nil
+	}
+
+	// publish database, LATEST files last so they never point to a missing file
+	dbpath := "db/" + d.name + "/" + d.os + "/" + d.arch + "/"
+	log.Printf("apkgdb: publishing database version %s to %s", stamp, dbpath)
+
+	files := []*PublishFile{
+		{Key: dbpath + stamp + ".bin", Path: fn, CacheControl: "max-age=31536000", ContentType: "application/octet-stream"},
+	}
+	for _, delta := range deltas {
+		files = append(files, &PublishFile{Key: dbpath + filepath.Base(delta), Path: delta, CacheControl: "max-age=31536000", ContentType: "application/octet-stream"})
+	}
+	files = append(files, []*PublishFile{
+		{Key: dbpath + "LATEST.txt", Path: filepath.Join(d.path, "LATEST.txt"), CacheControl: "max-age=60", ContentType: "text/plain"},
+		{Key: dbpath + "LATEST.jwt", Path: filepath.Join(d.path, "LATEST.jwt"), CacheControl: "max-age=60", ContentType: "text/plain"},
+	}...)
+	for _, f := range files {
+		if err := pub.Publish(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExport writes a signed database file. If base is not nil, packages
+// whose hash is in base are omitted and the file is flagged as a delta from
+// version baseV.
+func (d *DB) writeExport(fn string, now time.Time, keys []hsm.Key, base map[string]bool, baseV time.Time) error {
+	sigSize := apkgsig.SignatureSize
+	if len(keys) > 1 {
+		sigSize = apkgsig.MultiSignatureSize(len(keys))
+	}
+	var flags uint64
+	if base != nil {
+		flags |= dbFlagDelta
+	}
+
 	f, err := os.Create(fn)
 	if err != nil {
 		return err
@@ -47,7 +161,7 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 	if err := binary.Write(f, binary.BigEndian, uint32(0x00000001)); err != nil { // version
 		return err
 	}
-	if err := binary.Write(f, binary.BigEndian, uint64(0)); err != nil { // flags
+	if err := binary.Write(f, binary.BigEndian, flags); err != nil { // flags
 		return err
 	}
 	if err := binary.Write(f, binary.BigEndian, uint64(now.Unix())); err != nil {
@@ -82,7 +196,7 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 
 	// 76
 	for _, v := range []interface{}{
-		uint32(196 + apkgsig.SignatureSize), uint32(0), // data location + length
+		uint32(196 + sigSize), uint32(0), // data location + length
 	} {
 		if err := binary.Write(f, binary.BigEndian, v); err != nil {
 			return err
@@ -91,11 +205,18 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 	if _, err := f.Write(emptyHash); err != nil { // hash of data
 		return err
 	}
-	// 110
-	for _, v := range []interface{}{uint32(0), uint32(0)} { // id index location + length
-		if err := binary.Write(f, binary.BigEndian, v); err != nil {
+	// 116
+	if base != nil {
+		// deltas have no id index, the field holds the version they apply to
+		if err := binary.Write(f, binary.BigEndian, uint64(baseV.Unix())); err != nil {
 			return err
 		}
+	} else {
+		for _, v := range []interface{}{uint32(0), uint32(0)} { // id index location + length
+			if err := binary.Write(f, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
 	}
 	if _, err := f.Write(emptyHash); err != nil { // hash of id index
 		return err
@@ -116,7 +237,7 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 		return errors.New("invalid header length")
 	}
 
-	if _, err := f.Write(make([]byte, apkgsig.SignatureSize)); err != nil { // reserved space for signature
+	if _, err := f.Write(make([]byte, sigSize)); err != nil { // reserved space for signature
 		return err
 	}
 
@@ -145,6 +266,10 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 
 		if err := p2pB.ForEach(func(k, v []byte) error {
 			h := v[:32]
+			if base[string(h)] {
+				// already in the base of a delta
+				return nil
+			}
 
 			// load info
 			pkg := pkgB.Get(h)
@@ -172,7 +297,7 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 		// Write pin entries (type 0x01) after packages
 		pinsB := tx.Bucket([]byte("pins"))
 		if pinsB != nil {
-			return pinsB.ForEach(func(k, v []byte) error {
+			err := pinsB.ForEach(func(k, v []byte) error {
 				// key is "channel\x00prefix", value is version
 				if _, err := w.Write([]byte{0x01}); err != nil {
 					return err
@@ -190,6 +315,24 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 				}
 				return nil
 			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Write revoked keys (type 0x02)
+		revokedB := tx.Bucket([]byte("revoked"))
+		if revokedB != nil {
+			return revokedB.ForEach(func(k, v []byte) error {
+				if _, err := w.Write([]byte{0x02}); err != nil {
+					return err
+				}
+				if err := apkgsig.WriteVarblob(w, k); err != nil {
+					return err
+				}
+				_, err := w.Write(v)
+				return err
+			})
 		}
 
 		return nil
@@ -214,11 +357,11 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 		return err
 	}
 
-	if _, err = f.Seek(76, io.SeekStart); err != nil { // length of data, data starts at 196+128
+	if _, err = f.Seek(76, io.SeekStart); err != nil { // length of data, data starts after the signature
 		return err
 	}
 	var start uint32
-	if err = binary.Read(f, binary.BigEndian, &start); err != nil { // should be reading 196+128
+	if err = binary.Read(f, binary.BigEndian, &start); err != nil { // should be reading 196+sigSize
 		return err
 	}
 	if err = binary.Write(f, binary.BigEndian, uint32(pos)-start); err != nil { // write length of data
@@ -235,14 +378,14 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 		return err
 	}
 
-	log.Printf("apkgdb: Exported %d packages (%s), signing...", count, formatSize(datasize))
-	sigB, err := apkgsig.Sign(k, header)
+	log.Printf("apkgdb: Exported %d packages (%s) to %s, signing...", count, formatSize(datasize), path.Base(fn))
+	sigB, err := apkgsig.SignDb(keys, header)
 	if err != nil {
 		return err
 	}
 
 	// verify signature
-	_, err = apkgsig.VerifyDb(header, bytes.NewReader(sigB))
+	_, err = apkgsig.VerifyDb(d.name, header, bytes.NewReader(sigB), d.signers...)
 	if err != nil {
 		return err
 	}
@@ -258,74 +401,6 @@ func (d *DB) ExportAndUpload(k hsm.Key) error {
 		return err
 	}
 
-	// call index on file to check if the generated file is 100% valid
-	f, err = os.Open(fn)
-	if err != nil {
-		return err // ???
-	}
-
-	err = d.index(f)
-	f.Close()
-	if err != nil {
-		return err // failed to index: must be an error in file creation
-	}
-
-	// Generate LATEST.txt
-	lat, err := os.Create(path.Join(d.path, "LATEST.txt"))
-	if err != nil {
-		return err
-	}
-	fmt.Fprintf(lat, "%s\n", stamp)
-	if err := lat.Close(); err != nil {
-		return err
-	}
-
-	// generate LATEST.jwt
-	sig_pub, err := k.PublicBlob()
-	if err != nil {
-		return err
-	}
-
-	lat, err = os.Create(path.Join(d.path, "LATEST.jwt"))
-	if err != nil {
-		return err
-	}
-	token := jwt.New(jwt.EdDSA)
-	for k, v := range map[string]string{"ver": stamp, "arch": d.arch, "os": d.os, "name": d.name} {
-		if err = token.Payload().Set(k, v); err != nil {
-			return err
-		}
-	}
-	if err = token.Header().Set("kid", base64.RawURLEncoding.EncodeToString(sig_pub)); err != nil {
-		return err
-	}
-	tokenString, err := token.Sign(rand.Reader, k)
-	if err != nil {
-		return err
-	}
-	fmt.Fprintf(lat, "%s\n", tokenString)
-	if err := lat.Close(); err != nil {
-		return err
-	}
-
-	// upload database
-	s3pfxCf := "s3:/" + path.Join("/azusa/db", d.name, d.os, d.arch)
-	log.Printf("apkgdb: uploading files to cf:%s", s3pfxCf)
-
-	commands := [][]string{
-		[]string{"aws", "s3", "--profile", "cf", "cp", "--cache-control", "max-age=31536000", fn, s3pfxCf + "/" + stamp + ".bin"},
-		[]string{"aws", "s3", "--profile", "cf", "cp", "--cache-control", "max-age=60", filepath.Join(d.path, "/LATEST.txt"), s3pfxCf + "/LATEST.txt"},
-		[]string{"aws", "s3", "--profile", "cf", "cp", "--cache-control", "max-age=60", "--content-type", "text/plain", filepath.Join(d.path, "LATEST.jwt"), s3pfxCf + "/LATEST.jwt"},
-	}
-
-	for _, c := range commands {
-		cmd := exec.Command(c[0], c[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
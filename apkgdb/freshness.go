@@ -0,0 +1,97 @@
+package apkgdb
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// versionFormat is the format of database version strings. Versions are
+// fixed length, so they can be compared as strings.
+const versionFormat = "20060102150405"
+
+// DefaultMaxAgeWarn is the default age of the database after which a warning
+// is logged, as it may mean updates are being withheld (freeze attack).
+const DefaultMaxAgeWarn = 7 * 24 * time.Hour
+
+// SetMaxAge configures how old the database may get. A warning is logged
+// when the loaded database was signed more than warn ago, and updates signed
+// more than refuse ago are rejected. A zero value disables the check.
+func (d *DB) SetMaxAge(warn, refuse time.Duration) {
+	d.maxAgeWarn = warn
+	d.maxAgeRefuse = refuse
+	d.subLk.RLock()
+	for _, sub := range d.sub {
+		sub.maxAgeWarn = warn
+		sub.maxAgeRefuse = refuse
+	}
+	d.subLk.RUnlock()
+}
+
+// MaxVersion returns the highest database version ever loaded, which can be
+// higher than CurrentVersion if a more recent version was seen in the past.
+func (d *DB) MaxVersion() (v string) {
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr == nil {
+		return ""
+	}
+
+	_ = d.dbptr.View(func(tx *bolt.Tx) error {
+		v = maxVersionTx(tx)
+		return nil
+	})
+	return
+}
+
+func maxVersionTx(tx *bolt.Tx) string {
+	b := tx.Bucket([]byte("info"))
+	if b == nil {
+		return ""
+	}
+	v := string(b.Get([]byte("version")))
+	if m := string(b.Get([]byte("max_version"))); m > v {
+		return m
+	}
+	return v
+}
+
+// checkVersion returns an error if version is older than a version we have
+// already seen, which would mean an attempt to roll back the database.
+func (d *DB) checkVersion(version string) error {
+	if len(version) != len(versionFormat) {
+		return fmt.Errorf("invalid database version %q", version)
+	}
+	if m := d.MaxVersion(); version < m {
+		return fmt.Errorf("refusing database version %s older than already seen version %s", version, m)
+	}
+	return nil
+}
+
+// checkAge checks the signing time of the latest database against the
+// configured maximum age.
+func (d *DB) checkAge(signed time.Time) error {
+	age := time.Since(signed)
+	if d.maxAgeRefuse > 0 && age > d.maxAgeRefuse {
+		return fmt.Errorf("latest %s database was signed %s ago, refusing possibly frozen update", d.name, age.Truncate(time.Minute))
+	}
+	return nil
+}
+
+// checkFreshness logs a warning if the currently loaded database is older
+// than the configured warning age.
+func (d *DB) checkFreshness() {
+	if d.maxAgeWarn <= 0 {
+		return
+	}
+	t, err := time.Parse(versionFormat, d.CurrentVersion())
+	if err != nil {
+		return
+	}
+	if age := time.Since(t); age > d.maxAgeWarn {
+		log.Printf("apkgdb: WARNING: %s database was not updated for %s, updates may be withheld", d.name, age.Truncate(time.Minute))
+	}
+}
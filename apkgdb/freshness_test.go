@@ -0,0 +1,70 @@
+package apkgdb
+
+import (
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCheckVersion(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	// empty database accepts anything valid
+	if err := d.checkVersion("20250101000000"); err != nil {
+		t.Errorf("unexpected error on empty database: %s", err)
+	}
+	if err := d.checkVersion("garbage"); err == nil {
+		t.Errorf("expected error for invalid version")
+	}
+
+	err := d.dbptr.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("info"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("version"), []byte("20250101000000")); err != nil {
+			return err
+		}
+		return b.Put([]byte("max_version"), []byte("20250201000000"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := d.MaxVersion(); v != "20250201000000" {
+		t.Errorf("expected max version 20250201000000, got %s", v)
+	}
+
+	for v, ok := range map[string]bool{
+		"20250101000000": false, // current, but older than max seen
+		"20250201000000": true,
+		"20250301000000": true,
+		"20241231235959": false,
+	} {
+		err := d.checkVersion(v)
+		if ok && err != nil {
+			t.Errorf("version %s: unexpected error %s", v, err)
+		} else if !ok && err == nil {
+			t.Errorf("version %s: expected downgrade to be refused", v)
+		}
+	}
+}
+
+func TestCheckAge(t *testing.T) {
+	d := &DB{name: "test"}
+
+	// disabled by default
+	if err := d.checkAge(time.Now().Add(-365 * 24 * time.Hour)); err != nil {
+		t.Errorf("unexpected error with check disabled: %s", err)
+	}
+
+	d.SetMaxAge(time.Hour, 48*time.Hour)
+	if err := d.checkAge(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Errorf("unexpected error for recent database: %s", err)
+	}
+	if err := d.checkAge(time.Now().Add(-72 * time.Hour)); err == nil {
+		t.Errorf("expected stale database to be refused")
+	}
+}
@@ -3,8 +3,11 @@ package apkgdb
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/AzusaOS/apkg/apkgsig"
 	"github.com/KarpelesLab/smartremote"
@@ -56,6 +59,11 @@ func (d *DB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		d = db
 	}
 
+	if _, endpoint, ok := strings.Cut(r.URL.Path, "/v1/"); ok {
+		d.serveAPI(w, r, endpoint)
+		return
+	}
+
 	act := r.URL.Query().Get("action")
 
 	switch act {
@@ -70,8 +78,23 @@ func (d *DB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Name: %s\n", d.name)
 		fmt.Fprintf(w, "OS: %s\n", d.os)
 		fmt.Fprintf(w, "Arch: %s\n", d.arch)
-		fmt.Fprintf(w, "Prefix: %s\n", d.prefix)
+		fmt.Fprintf(w, "Mirrors:\n")
+		for _, mi := range d.Mirrors() {
+			if mi.Healthy {
+				fmt.Fprintf(w, "  - %s (ok)\n", mi.Prefix)
+			} else {
+				fmt.Fprintf(w, "  - %s (failing, %d errors, retry at %s: %s)\n", mi.Prefix, mi.Failures, mi.RetryAt.Format(time.RFC3339), mi.LastError)
+			}
+		}
 		fmt.Fprintf(w, "Version: %s\n", d.CurrentVersion())
+		fmt.Fprintf(w, "Highest version seen: %s\n", d.MaxVersion())
+		if usage, limit, err := d.CacheUsage(); err == nil {
+			if limit > 0 {
+				fmt.Fprintf(w, "Package cache: %s (limit %s)\n", formatSize(uint64(usage)), formatSize(uint64(limit)))
+			} else {
+				fmt.Fprintf(w, "Package cache: %s\n", formatSize(uint64(usage)))
+			}
+		}
 
 		subs := d.ListSubs()
 		if len(subs) > 0 {
@@ -91,9 +114,16 @@ func (d *DB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // http client (global)
+// There is no global timeout since package downloads can be long, but
+// connecting and waiting for response headers are bounded so that a stuck
+// mirror causes a failover to the next one.
 var hClient = &http.Client{
 	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{RootCAs: apkgsig.CACerts()},
+		TLSClientConfig:       &tls.Config{RootCAs: apkgsig.CACerts()},
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
 	},
 }
 
@@ -55,6 +55,7 @@ func (d *DB) index(r *os.File) error {
 	created := time.Unix(createdA[0], createdA[1])
 
 	log.Printf("apkgdb: reading database generated on %s (%s ago)", created, time.Since(created))
+	createdV := created.UTC().Format(versionFormat)
 
 	osarchcnt := make([]uint32, 3)
 	err = binary.Read(r, binary.BigEndian, osarchcnt)
@@ -122,11 +123,17 @@ func (d *DB) index(r *os.File) error {
 	if _, err = r.Seek(196, io.SeekStart); err != nil {
 		return err
 	}
-	_, err = apkgsig.VerifyDb(headerData, bufio.NewReader(r))
+	_, err = apkgsig.VerifyDb(d.name, headerData, bufio.NewReader(r), d.signers...)
 	if err != nil {
 		return err
 	}
 
+	// a delta holds the version it applies to in place of the id index
+	var baseV string
+	if flags&dbFlagDelta != 0 {
+		baseV = time.Unix(int64(binary.BigEndian.Uint64(headerData[116:124])), 0).UTC().Format(versionFormat)
+	}
+
 	// TODO → use indices
 
 	if _, err = r.Seek(int64(dataLoc[0]), io.SeekStart); err != nil {
@@ -141,6 +148,8 @@ func (d *DB) index(r *os.File) error {
 	}
 	defer d.writeEnd()
 
+	var revokedChanged bool
+
 	// initialize a write transaction
 	err = d.dbptr.Update(func(tx *bolt.Tx) error {
 		// create/get buckets
@@ -176,10 +185,57 @@ func (d *DB) index(r *os.File) error {
 		if err != nil {
 			return err
 		}
-		pinsB, err := tx.CreateBucketIfNotExists([]byte("pins"))
+		// every database file, including deltas, carries all the pins, so
+		// pins removed since the last update must go away
+		if tx.Bucket([]byte("pins")) != nil {
+			if err := tx.DeleteBucket([]byte("pins")); err != nil {
+				return err
+			}
+		}
+		pinsB, err := tx.CreateBucket([]byte("pins"))
+		if err != nil {
+			return err
+		}
+		provB, err := metaIndexTx(tx, "provides", addProvidesTx)
 		if err != nil {
 			return err
 		}
+		virtB, err := metaIndexTx(tx, "virtual", addVirtualTx)
+		if err != nil {
+			return err
+		}
+		// revocations are carried the same way as pins, remember the
+		// previous ones to recheck the packages if they changed
+		oldRevoked := make(map[string]string)
+		if b := tx.Bucket([]byte("revoked")); b != nil {
+			_ = b.ForEach(func(k, v []byte) error {
+				oldRevoked[string(k)] = string(v)
+				return nil
+			})
+			if err := tx.DeleteBucket([]byte("revoked")); err != nil {
+				return err
+			}
+		}
+		revokedB, err := tx.CreateBucket([]byte("revoked"))
+		if err != nil {
+			return err
+		}
+
+		if flags&dbFlagDelta != 0 {
+			curV := infoB.Get([]byte("version"))
+			if curV == nil {
+				return errors.New("database delta can only be applied to an existing database")
+			}
+			if string(curV) != baseV {
+				return fmt.Errorf("database delta from version %s cannot be applied to version %s", baseV, curV)
+			}
+		}
+
+		// refuse to go back in time
+		maxVersion := maxVersionTx(tx)
+		if createdV < maxVersion {
+			return fmt.Errorf("refusing database version %s older than already seen version %s", createdV, maxVersion)
+		}
 
 		// OK now let's read each package
 		for i := uint32(0); i < count; i++ {
@@ -283,6 +339,12 @@ func (d *DB) index(r *os.File) error {
 			if err != nil {
 				return err
 			}
+			if err := addProvidesTx(provB, name, meta); err != nil {
+				return err
+			}
+			if err := addVirtualTx(virtB, name, meta); err != nil {
+				return err
+			}
 			if meta != nil && meta.LDSO != nil {
 				data, err := ldcache.Read(bytes.NewReader(meta.LDSO))
 				if err != nil {
@@ -301,7 +363,7 @@ func (d *DB) index(r *os.File) error {
 			//log.Printf("read package %s size=%d", name, size)
 		}
 
-		// Read pin entries (type 0x01) that follow packages
+		// Read pin (type 0x01) and revocation (type 0x02) entries that follow packages
 		for {
 			var t uint8
 			err = binary.Read(b, binary.BigEndian, &t)
@@ -309,6 +371,23 @@ func (d *DB) index(r *os.File) error {
 				// EOF or end of data section — normal termination
 				break
 			}
+			if t == 0x02 {
+				key, err := apkgsig.ReadVarblob(b, 256)
+				if err != nil {
+					return err
+				}
+				cutoff := make([]byte, 8)
+				if _, err := io.ReadFull(b, cutoff); err != nil {
+					return err
+				}
+				if err := revokedB.Put(key, cutoff); err != nil {
+					return err
+				}
+				if oldRevoked[string(key)] != string(cutoff) {
+					revokedChanged = true
+				}
+				continue
+			}
 			if t != 0x01 {
 				return fmt.Errorf("invalid data in db (unexpected type %d after packages)", t)
 			}
@@ -331,8 +410,15 @@ func (d *DB) index(r *os.File) error {
 			}
 		}
 
+		if err := pruneProvidesTx(tx); err != nil {
+			return err
+		}
+
 		// store version
-		if err := infoB.Put([]byte("version"), []byte(created.UTC().Format("20060102150405"))); err != nil {
+		if err := infoB.Put([]byte("version"), []byte(createdV)); err != nil {
+			return err
+		}
+		if err := infoB.Put([]byte("max_version"), []byte(createdV)); err != nil {
 			return err
 		}
 
@@ -344,6 +430,12 @@ func (d *DB) index(r *os.File) error {
 		return err
 	}
 
+	d.resetVirtual()
+	// unload the packages this update replaced, once the write lock is released
+	go d.releaseStale()
+	if revokedChanged {
+		go d.recheckRevoked()
+	}
 	return d.buildLdso()
 }
 
@@ -384,6 +476,14 @@ func (d *DB) AddPackage(rpath string, info os.FileInfo, p *Package) error {
 		if err != nil {
 			return err
 		}
+		provB, err := tx.CreateBucketIfNotExists([]byte("provides"))
+		if err != nil {
+			return err
+		}
+		virtB, err := tx.CreateBucketIfNotExists([]byte("virtual"))
+		if err != nil {
+			return err
+		}
 
 		exInfo := pkgB.Get(p.hash)
 		if exInfo != nil {
@@ -423,6 +523,15 @@ func (d *DB) AddPackage(rpath string, info os.FileInfo, p *Package) error {
 		if err != nil {
 			return err
 		}
+		var meta *PackageMeta
+		if json.Unmarshal(p.rawMeta, &meta) == nil {
+			if err := addProvidesTx(provB, []byte(p.name), meta); err != nil {
+				return err
+			}
+			if err := addVirtualTx(virtB, []byte(p.name), meta); err != nil {
+				return err
+			}
+		}
 
 		//log.Printf("read package %s size=%d", name, size)
 		return nil
@@ -446,3 +555,39 @@ func (d *DB) RemovePackage(name string) error {
 		return p2pB.Delete(nameC)
 	})
 }
+
+// metaIndexFunc adds the entries derived from a package's metadata to an
+// index bucket.
+type metaIndexFunc func(b *bolt.Bucket, name []byte, meta *PackageMeta) error
+
+// metaIndexTx returns the given index bucket, creating it if needed. Newly
+// created buckets are filled from the metadata of all known packages, for
+// databases indexed before the bucket existed.
+func metaIndexTx(tx *bolt.Tx, bucket string, add metaIndexFunc) (*bolt.Bucket, error) {
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		return b, nil
+	}
+	b, err := tx.CreateBucket([]byte(bucket))
+	if err != nil {
+		return nil, err
+	}
+
+	p2pB := tx.Bucket([]byte("p2p"))
+	metaB := tx.Bucket([]byte("meta"))
+	if p2pB == nil || metaB == nil {
+		return b, nil
+	}
+
+	log.Printf("apkgdb: building %s index", bucket)
+
+	return b, p2pB.ForEach(func(k, v []byte) error {
+		if len(v) < 32+8 {
+			return nil
+		}
+		var meta *PackageMeta
+		if err := json.Unmarshal(metaB.Get(v[:32]), &meta); err != nil {
+			return nil
+		}
+		return add(b, v[32+8:], meta)
+	})
+}
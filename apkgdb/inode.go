@@ -2,8 +2,12 @@ package apkgdb
 
 import (
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/AzusaOS/apkg/apkgfs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -24,11 +28,49 @@ func (i *DB) Open(flags uint32) (uint32, error) {
 }
 
 func (i *DB) OpenDir() (uint32, error) {
-	return 0, os.ErrPermission
+	return 0, nil
 }
 
+func (d *DB) OpenDirHandle() (uint64, uint32, error) {
+	return d.rootDirs.open(), 0, nil
+}
+
+func (d *DB) ReleaseDir(fh uint64) {
+	d.rootDirs.release(fh)
+}
+
+// ReadDir lists ld.so.cache and .virtual, followed by the packages of the
+// database in natural order. The list is computed when a listing starts at
+// offset zero and kept with the directory handle, so the kernel can read it
+// in several calls from a consistent snapshot.
 func (d *DB) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) error {
-	return os.ErrPermission
+	list := d.rootDirs.list(input, func() []string {
+		list := d.getPackagesList()
+		if d.listShort.Load() {
+			list = shortNames(list)
+		}
+		return list
+	})
+
+	// full names are the package directory, other names are symlinks to it
+	mode := os.ModeDir | 0555
+	if d.listShort.Load() {
+		mode = os.ModeSymlink | 0444
+	}
+
+	entries := make([]dirEntry, 0, len(list)+2)
+	entries = append(entries, dirEntry{name: "ld.so.cache", ino: 2, mode: 0444}, dirEntry{name: ".virtual", ino: 3, inode: virtualRoot{d: d}})
+	for _, name := range list {
+		entries = append(entries, dirEntry{name: name, mode: mode})
+	}
+
+	return fillDir(input, out, plus, 1, 1, d, entries)
+}
+
+// SetListShort selects whether listing the root of the filesystem returns
+// package names without version, os and arch instead of full names.
+func (d *DB) SetListShort(short bool) {
+	d.listShort.Store(short)
 }
 
 func (i *DB) AddRef(count uint64) uint64 {
@@ -51,3 +93,128 @@ func (i *DB) StatFs(out *fuse.StatfsOut) error {
 
 	return nil
 }
+
+// dirEntry is an entry of a directory generated by apkgdb. If inode is nil,
+// the entry is listed with the given mode and no attributes, and the kernel
+// will perform a lookup when it is accessed.
+type dirEntry struct {
+	name  string
+	ino   uint64
+	mode  os.FileMode
+	inode apkgfs.Inode
+}
+
+// fillDir adds directory entries to out, starting at the offset requested
+// by the kernel. Offsets 0 and 1 are "." and "..".
+func fillDir(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool, ino, parent uint64, self apkgfs.Inode, entries []dirEntry) error {
+	all := append([]dirEntry{{name: ".", ino: ino, inode: self}, {name: "..", ino: parent, mode: os.ModeDir}}, entries...)
+
+	for _, e := range all[min(input.Offset, uint64(len(all))):] {
+		mode := e.mode
+		if e.inode != nil {
+			mode = e.inode.Mode()
+		}
+		de := fuse.DirEntry{Mode: apkgfs.ModeToUnix(mode), Name: e.name, Ino: e.ino}
+
+		if !plus {
+			if !out.AddDirEntry(de) {
+				return nil
+			}
+			continue
+		}
+
+		entry := out.AddDirLookupEntry(de)
+		if entry == nil {
+			return nil
+		}
+		if e.inode == nil || e.name == "." || e.name == ".." {
+			// no node id, the kernel will lookup the entry if needed
+			continue
+		}
+		if err := e.inode.FillAttr(&entry.Attr); err != nil {
+			return err
+		}
+		entry.NodeId = e.ino
+		entry.Attr.Ino = e.ino
+		entry.SetEntryTimeout(time.Second)
+		entry.SetAttrTimeout(time.Second)
+	}
+	return nil
+}
+
+// dirHandles keeps the entries listed by a directory per open handle.
+type dirHandles struct {
+	lk   sync.Mutex
+	next uint64
+	m    map[uint64][]string
+}
+
+func (h *dirHandles) open() uint64 {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if h.m == nil {
+		h.m = make(map[uint64][]string)
+	}
+	h.next += 1
+	h.m[h.next] = nil
+	return h.next
+}
+
+func (h *dirHandles) release(fh uint64) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	delete(h.m, fh)
+}
+
+// list returns the entries of the handle in input.Fh, calling get to take a
+// new snapshot when reading from offset zero. Reads without a known handle
+// always take a new snapshot.
+func (h *dirHandles) list(input *fuse.ReadIn, get func() []string) []string {
+	h.lk.Lock()
+	list, ok := h.m[input.Fh]
+	h.lk.Unlock()
+
+	if ok && list != nil && input.Offset != 0 {
+		return list
+	}
+	list = get()
+
+	h.lk.Lock()
+	if _, ok := h.m[input.Fh]; ok {
+		h.m[input.Fh] = list
+	}
+	h.lk.Unlock()
+	return list
+}
+
+// shortNames returns the list of package names without version, os and
+// arch, in natural order.
+func shortNames(list []string) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0, len(list))
+	for _, name := range list {
+		short := shortName(name)
+		if !seen[short] {
+			seen[short] = true
+			res = append(res, short)
+		}
+	}
+	natSort(res)
+	return res
+}
+
+// shortName strips the version, os and arch from a full package name, for
+// example sys-libs.glibc.libs.2.41.linux.amd64 becomes sys-libs.glibc.libs.
+// The version is the first element after category, name and subcat that
+// starts with a digit.
+func shortName(name string) string {
+	parts := strings.Split(name, ".")
+	for i := 3; i < len(parts); i++ {
+		if parts[i] != "" && parts[i][0] >= '0' && parts[i][0] <= '9' {
+			return strings.Join(parts[:i], ".")
+		}
+	}
+	return name
+}
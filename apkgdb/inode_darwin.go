@@ -32,3 +32,31 @@ func (i *ldsoIno) FillAttr(attr *fuse.Attr) error {
 	attr.Ctimensec = 0
 	return nil
 }
+
+func (r virtualRoot) FillAttr(attr *fuse.Attr) error {
+	attr.Ino = 3
+	attr.Size = 4096
+	attr.Blocks = 1
+	attr.Mode = apkgfs.ModeToUnix(r.Mode())
+	attr.Nlink = 1 // 1 required
+	attr.Rdev = 1
+	//attr.Blksize = 4096
+	attr.Atimensec = 0
+	attr.Mtimensec = 0
+	attr.Ctimensec = 0
+	return nil
+}
+
+func (dir *virtualDir) FillAttr(attr *fuse.Attr) error {
+	attr.Ino = dir.ino
+	attr.Size = 4096
+	attr.Blocks = 1
+	attr.Mode = apkgfs.ModeToUnix(dir.Mode())
+	attr.Nlink = 1 // 1 required
+	attr.Rdev = 1
+	//attr.Blksize = 4096
+	attr.Atimensec = 0
+	attr.Mtimensec = 0
+	attr.Ctimensec = 0
+	return nil
+}
@@ -0,0 +1,131 @@
+package apkgdb
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readDirNames lists a directory the way the kernel does, in several calls
+// using a small buffer, and returns the names in the order received.
+func readDirNames(t *testing.T, d *DB) []string {
+	t.Helper()
+	fh, _, err := d.OpenDirHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.ReleaseDir(fh)
+
+	var res []string
+	var off uint64
+
+	for {
+		names, next := readDirPage(t, d, fh, off)
+		if next == off {
+			return res
+		}
+		res = append(res, names...)
+		off = next
+	}
+}
+
+// readDirPage reads the entries of handle fh starting at off, and returns
+// their names and the offset to continue from.
+func readDirPage(t *testing.T, d *DB, fh, off uint64) ([]string, uint64) {
+	t.Helper()
+	var res []string
+
+	buf := make([]byte, 128)
+	out := fuse.NewDirEntryList(buf, off)
+	if err := d.ReadDir(&fuse.ReadIn{Fh: fh, Offset: off}, out, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// parse struct fuse_dirent entries
+	for p := 0; p+24 <= len(buf); {
+		namelen := int(binary.LittleEndian.Uint32(buf[p+16:]))
+		if namelen == 0 {
+			break
+		}
+		res = append(res, string(buf[p+24:p+24+namelen]))
+		p += (24 + namelen + 7) &^ 7
+	}
+	return res, out.Offset
+}
+
+func TestRootReadDir(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	addTestPackages(t, d, `{}`,
+		"sys-libs.glibc.libs.2.41.linux.amd64",
+		"dev-lang.python.core.3.9.0.linux.amd64",
+		"dev-lang.python.core.3.12.1.linux.amd64",
+		"media-libs.x264.core.0.164.linux.amd64",
+	)
+
+	expected := []string{".", "..", "ld.so.cache", ".virtual",
+		"dev-lang.python.core.3.9.0.linux.amd64",
+		"dev-lang.python.core.3.12.1.linux.amd64",
+		"media-libs.x264.core.0.164.linux.amd64",
+		"sys-libs.glibc.libs.2.41.linux.amd64",
+	}
+	if names := readDirNames(t, d); !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected root listing %q", names)
+	}
+
+	d.SetListShort(true)
+	expected = []string{".", "..", "ld.so.cache", ".virtual", "dev-lang.python.core", "media-libs.x264.core", "sys-libs.glibc.libs"}
+	if names := readDirNames(t, d); !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected short root listing %q", names)
+	}
+}
+
+func TestRootReadDirHandles(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.SetListShort(true)
+
+	addTestPackages(t, d, `{}`, "dev-lang.python.core.3.12.1.linux.amd64", "media-libs.x264.core.0.164.linux.amd64", "sys-libs.glibc.libs.2.41.linux.amd64")
+
+	first, _, _ := d.OpenDirHandle()
+	defer d.ReleaseDir(first)
+	names, off := readDirPage(t, d, first, 0)
+
+	// a listing started by another handle does not change the first one
+	addTestPackages(t, d, `{}`, "app-arch.7zip.core.23.01.linux.amd64")
+	other, _, _ := d.OpenDirHandle()
+	defer d.ReleaseDir(other)
+	readDirPage(t, d, other, 0)
+
+	for {
+		page, next := readDirPage(t, d, first, off)
+		if next == off {
+			break
+		}
+		names = append(names, page...)
+		off = next
+	}
+
+	expected := []string{".", "..", "ld.so.cache", ".virtual", "dev-lang.python.core", "media-libs.x264.core", "sys-libs.glibc.libs"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected listing %q", names)
+	}
+}
+
+func TestShortName(t *testing.T) {
+	tests := map[string]string{
+		"sys-libs.glibc.libs.2.41.linux.amd64":        "sys-libs.glibc.libs",
+		"media-libs.x264.core.0.164.linux.amd64":      "media-libs.x264.core",
+		"app-arch.7zip.core.23.01.linux.amd64":        "app-arch.7zip.core",
+		"sys-libs.glibc.data.locale.2.41.linux.amd64": "sys-libs.glibc.data.locale",
+		"noversion": "noversion",
+	}
+	for in, out := range tests {
+		if v := shortName(in); v != out {
+			t.Errorf("shortName(%q) = %q, want %q", in, v, out)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package apkgdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AzusaOS/apkg/apkgfs"
+	"github.com/KarpelesLab/ldcache"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Layers is a filesystem root merging several databases. Lookups are tried
+// on each layer in order and the first one resolving the name wins, so a
+// package in an upper layer shadows the same package prefix in the layers
+// below. The root lists the packages of all layers, and ld.so.cache merges
+// the libraries of all layers, upper layers first. .virtual is the one of
+// the last (base) layer.
+//
+// Each database must have its own inode range, see DB.SetInodeBase.
+type Layers struct {
+	layers []*DB // upper layer first
+	refcnt uint64
+	ntgt   atomic.Value // stores NotifyTarget
+
+	ldso   []byte
+	ldsoLk sync.Mutex
+
+	rootDirs dirHandles // names listed in the root directory, per open handle
+}
+
+// NewLayers returns a root merging the given databases, the first one
+// having the highest priority. The last database is the base layer.
+func NewLayers(layers ...*DB) (*Layers, error) {
+	if len(layers) < 2 {
+		return nil, errors.New("layers: at least two databases are required")
+	}
+	bases := make(map[uint64]string)
+	for _, d := range layers {
+		if other, ok := bases[d.inoBase]; ok {
+			return nil, fmt.Errorf("layers: databases %s and %s share the same inode range", other, d.name)
+		}
+		bases[d.inoBase] = d.name
+	}
+
+	l := &Layers{layers: layers}
+	l.buildLdso()
+	for _, d := range layers {
+		d.AddNotifyTarget(l)
+	}
+	return l, nil
+}
+
+func (l *Layers) base() *DB {
+	return l.layers[len(l.layers)-1]
+}
+
+// layerOf returns the database inode ino belongs to
+func (l *Layers) layerOf(ino uint64) *DB {
+	var res *DB
+	for _, d := range l.layers {
+		if d.inoBase <= ino && (res == nil || d.inoBase > res.inoBase) {
+			res = d
+		}
+	}
+	return res
+}
+
+// SetNotifyTarget sets the notification target of the merged filesystem.
+func (l *Layers) SetNotifyTarget(tgt NotifyTarget) {
+	l.ntgt.Store(tgt)
+}
+
+// NotifyInode receives the notifications of the layers. A change of the
+// ld.so.cache of a layer causes the merged one to be rebuilt.
+func (l *Layers) NotifyInode(ino uint64, offt int64, data []byte) error {
+	if ino == 2 {
+		return l.buildLdso()
+	}
+	if v := l.ntgt.Load(); v != nil {
+		return v.(NotifyTarget).NotifyInode(ino, offt, data)
+	}
+	return nil
+}
+
+// InodesInUse implements InodeTracker for the packages of the layers.
+func (l *Layers) InodesInUse(start, end uint64) bool {
+	if v := l.ntgt.Load(); v != nil {
+		if t, ok := v.(InodeTracker); ok {
+			return t.InodesInUse(start, end)
+		}
+	}
+	return true
+}
+
+// buildLdso merges the ld.so.cache of the layers
+func (l *Layers) buildLdso() error {
+	entries := make(map[string]*ldcache.Entry)
+	for i := len(l.layers) - 1; i >= 0; i-- {
+		// upper layers replace the libraries of the lower ones
+		for k, e := range l.layers[i].ldsoEntries() {
+			entries[k] = e
+		}
+	}
+
+	buf, err := encodeLdso(entries)
+	if err != nil {
+		return err
+	}
+
+	l.ldsoLk.Lock()
+	l.ldso = buf
+	l.ldsoLk.Unlock()
+
+	log.Printf("apkgdb: built merged ld.so.cache containing %d libs from %d layers", len(entries), len(l.layers))
+
+	if v := l.ntgt.Load(); v != nil {
+		return v.(NotifyTarget).NotifyInode(2, 0, buf)
+	}
+	return nil
+}
+
+func (l *Layers) Mode() os.FileMode {
+	return l.base().Mode()
+}
+
+func (l *Layers) FillAttr(attr *fuse.Attr) error {
+	return l.base().FillAttr(attr)
+}
+
+func (l *Layers) Readlink() ([]byte, error) {
+	return nil, os.ErrInvalid
+}
+
+func (l *Layers) Open(flags uint32) (uint32, error) {
+	return 0, os.ErrInvalid
+}
+
+func (l *Layers) OpenDir() (uint32, error) {
+	return 0, nil
+}
+
+func (l *Layers) OpenDirHandle() (uint64, uint32, error) {
+	return l.rootDirs.open(), 0, nil
+}
+
+func (l *Layers) ReleaseDir(fh uint64) {
+	l.rootDirs.release(fh)
+}
+
+func (l *Layers) AddRef(count uint64) uint64 {
+	return atomic.AddUint64(&l.refcnt, count)
+}
+
+func (l *Layers) DelRef(count uint64) uint64 {
+	return atomic.AddUint64(&l.refcnt, ^(count - 1))
+}
+
+func (l *Layers) StatFs(out *fuse.StatfsOut) error {
+	if err := l.base().StatFs(out); err != nil {
+		return err
+	}
+	for _, d := range l.layers[:len(l.layers)-1] {
+		out.Blocks += uint64(d.Length()) / 4096
+		out.Files += d.Inodes()
+	}
+	return nil
+}
+
+// Lookup resolves name in the first layer that knows it.
+func (l *Layers) Lookup(ctx context.Context, name string) (uint64, error) {
+	switch name {
+	case "ld.so.cache":
+		return 2, nil
+	case ".virtual":
+		return 3, nil
+	}
+
+	for _, d := range l.layers {
+		n, err := d.Lookup(ctx, name)
+		if !errors.Is(err, os.ErrNotExist) {
+			return n, err
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+// GetInode returns the inode from the layer owning its number.
+func (l *Layers) GetInode(reqino uint64) (apkgfs.Inode, error) {
+	switch reqino {
+	case 1: // root
+		return l, nil
+	case 2: // ld.so.cache
+		l.ldsoLk.Lock()
+		defer l.ldsoLk.Unlock()
+		return &ldsoIno{d: l.base(), ldso: l.ldso}, nil
+	case 3: // .virtual
+		return virtualRoot{d: l.base()}, nil
+	}
+
+	return l.layerOf(reqino).GetInode(reqino)
+}
+
+// ReadDir lists the packages of all the layers, in natural order.
+func (l *Layers) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) error {
+	short := l.base().listShort.Load()
+
+	list := l.rootDirs.list(input, func() []string {
+		seen := make(map[string]bool)
+		var list []string
+		for _, d := range l.layers {
+			for _, name := range d.getPackagesList() {
+				if short {
+					name = shortName(name)
+				}
+				if !seen[name] {
+					seen[name] = true
+					list = append(list, name)
+				}
+			}
+		}
+		natSort(list)
+		return list
+	})
+
+	// full names are the package directory, other names are symlinks to it
+	mode := os.ModeDir | 0555
+	if short {
+		mode = os.ModeSymlink | 0444
+	}
+
+	entries := make([]dirEntry, 0, len(list)+2)
+	entries = append(entries, dirEntry{name: "ld.so.cache", ino: 2, mode: 0444}, dirEntry{name: ".virtual", ino: 3, inode: virtualRoot{d: l.base()}})
+	for _, name := range list {
+		entries = append(entries, dirEntry{name: name, mode: mode})
+	}
+
+	return fillDir(input, out, plus, 1, 1, l, entries)
+}
@@ -0,0 +1,67 @@
+package apkgdb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/KarpelesLab/ldcache"
+)
+
+func TestLayers(t *testing.T) {
+	base, cleanup := newTestDB(t)
+	defer cleanup()
+	upper, cleanup2 := newTestDB(t)
+	defer cleanup2()
+
+	if _, err := NewLayers(upper, base); err == nil {
+		t.Error("expected error for databases sharing the same inode range")
+	}
+	upper.SetInodeBase(1 << 40)
+
+	addTestPackages(t, base, `{}`, "sys-libs.glibc.libs.2.41.linux.amd64", "dev-lang.python.core.3.12.1.linux.amd64")
+	addTestPackages(t, upper, `{}`, "sys-libs.glibc.libs.2.40.linux.amd64")
+	base.ldsoEnt = map[string]*ldcache.Entry{
+		"libc.so.6": {Flags: 0x303, Key: "libc.so.6", Value: "/pkg/main/sys-libs.glibc.libs.2.41.linux.amd64/lib64/libc.so.6"},
+		"libz.so.1": {Flags: 0x303, Key: "libz.so.1", Value: "/pkg/main/sys-libs.zlib.libs.1.3.linux.amd64/lib64/libz.so.1"},
+	}
+	upper.ldsoEnt = map[string]*ldcache.Entry{
+		"libc.so.6": {Flags: 0x303, Key: "libc.so.6", Value: "/pkg/corp/sys-libs.glibc.libs.2.40.linux.amd64/lib64/libc.so.6"},
+	}
+
+	l, err := NewLayers(upper, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	n, err := l.Lookup(ctx, "sys-libs.glibc.libs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1<<40 || l.layerOf(n) != upper {
+		t.Errorf("glibc should resolve in the upper layer, got inode %d", n)
+	}
+	n, err = l.Lookup(ctx, "dev-lang.python.core")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n >= 1<<40 || l.layerOf(n) != base {
+		t.Errorf("python should resolve in the base layer, got inode %d", n)
+	}
+	if _, err := l.Lookup(ctx, "dev-lang.go.core"); err == nil {
+		t.Error("expected lookup of a missing package to fail")
+	}
+
+	f, err := ldcache.Read(bytes.NewReader(l.ldso))
+	if err != nil {
+		t.Fatal(err)
+	}
+	libs := make(map[string]string)
+	for _, e := range f.Entries {
+		libs[e.Key] = e.Value
+	}
+	if len(libs) != 2 || libs["libc.so.6"] != upper.ldsoEnt["libc.so.6"].Value || libs["libz.so.1"] == "" {
+		t.Errorf("unexpected merged ld.so.cache %v", libs)
+	}
+}
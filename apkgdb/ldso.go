@@ -93,8 +93,34 @@ func (d *DB) buildLdso() error {
 		return err
 	}
 
-	//natSort(res)
+	buf, err := encodeLdso(entries)
+	if err != nil {
+		return err
+	}
+
+	d.ldsoLk.Lock()
+	d.ldso = buf
+	d.ldsoEnt = entries
+	d.ldsoLk.Unlock()
+
+	log.Printf("apkgdb: built ld.so.cache containing %d libs (%d bytes)", len(entries), len(buf))
+
+	// push to kernel (ld.so.cache inode = 2)
+	_ = d.notifyInode(2, 0, buf)
+
+	return nil
+}
 
+// ldsoEntries returns the entries of the database's ld.so.cache by library
+// name. The map must not be modified.
+func (d *DB) ldsoEntries() map[string]*ldcache.Entry {
+	d.ldsoLk.Lock()
+	defer d.ldsoLk.Unlock()
+	return d.ldsoEnt
+}
+
+// encodeLdso builds a ld.so.cache file from its entries
+func encodeLdso(entries map[string]*ldcache.Entry) ([]byte, error) {
 	f := ldcache.New()
 	for _, e := range entries {
 		f.Entries = append(f.Entries, e)
@@ -103,15 +129,7 @@ func (d *DB) buildLdso() error {
 
 	buf := &bytes.Buffer{}
 	if _, err := f.WriteTo(buf); err != nil {
-		return err
+		return nil, err
 	}
-
-	d.ldso = buf.Bytes()
-
-	log.Printf("apkgdb: built ld.so.cache containing %d libs (%d bytes)", len(entries), len(d.ldso))
-
-	// push to kernel (ld.so.cache inode = 2)
-	_ = d.notifyInode(2, 0, d.ldso)
-
-	return nil
+	return buf.Bytes(), nil
 }
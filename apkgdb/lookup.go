@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/AzusaOS/apkg/apkgfs"
 	"github.com/petar/GoLLRB/llrb"
@@ -28,6 +29,8 @@ func (i *DB) Lookup(ctx context.Context, name string) (n uint64, err error) {
 	switch name {
 	case "ld.so.cache":
 		return 2, nil
+	case ".virtual":
+		return 3, nil
 	}
 
 	// name can be suffixed by cpu/OS
@@ -52,12 +55,13 @@ func (i *DB) Lookup(ctx context.Context, name string) (n uint64, err error) {
 	sname = sname[:v]
 
 	// ok we got an OS & arch
+	ch := i.channelFor(ctx)
 	if i.osV == osV && i.archV == arch {
 		// this is us.
-		n, err = i.internalLookup(name)
+		n, err = i.channelLookup(ch, name)
 		if err == os.ErrNotExist {
 			// if error, try without the OS/arch suffix
-			n, err = i.internalLookup(sname)
+			n, err = i.channelLookup(ch, sname)
 		}
 		return
 	}
@@ -66,19 +70,24 @@ func (i *DB) Lookup(ctx context.Context, name string) (n uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	n, err = db.internalLookup(name)
+	n, err = db.channelLookup(ch, name)
 	if err == os.ErrNotExist {
 		// if error, try without the OS/arch suffix
-		n, err = db.internalLookup(sname)
+		n, err = db.channelLookup(ch, sname)
 	}
 	return
 }
 
-func (i *DB) ctxLookup(_ context.Context, name string) (n uint64, err error) {
-	return i.internalLookup(name)
+func (i *DB) ctxLookup(ctx context.Context, name string) (n uint64, err error) {
+	return i.channelLookup(i.channelFor(ctx), name)
 }
 
 func (i *DB) internalLookup(name string) (n uint64, err error) {
+	return i.channelLookup(i.channel, name)
+}
+
+// channelLookup resolves name using the pins of channel ch
+func (i *DB) channelLookup(ch, name string) (n uint64, err error) {
 	if strings.IndexByte(name, '.') == -1 {
 		// there can be no filename without a '.'
 		return 0, os.ErrNotExist
@@ -100,73 +109,82 @@ func (i *DB) internalLookup(name string) (n uint64, err error) {
 	}
 
 	err = i.dbptr.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("p2p"))
-		if b == nil {
-			return os.ErrNotExist
+		v, exact, err := i.resolveTx(tx, ch, name)
+		if err != nil {
+			return err
 		}
 
-		nameC := collatedVersion(name)
-
-		v := b.Get(nameC)
-		if v != nil {
+		n = i.pkgIno(v)
+		// we need to instanciate pkg at this point
+		pkg, err := i.getPkgTx(tx, n, v[:32])
+		if err != nil {
+			return err
+		}
+		pkg.looked.Store(time.Now().UnixNano())
+		if exact {
 			// exact match, return ino+1
-			n = i.pkgIno(v) + 1
-
-			// we need to instanciate pkg at this point
-			_, err := i.getPkgTx(tx, n-1, v[:32])
-			if err != nil {
-				return err
-			}
-			return nil
+			n += 1
 		}
+		return nil
+	})
 
-		// Check for a version pin on the active channel
-		if pin := i.lookupPinTx(tx, name); pin != "" {
-			// Constrain the cursor seek to the pinned version prefix
-			pinnedName := name + "." + pin
-			pinnedC := collatedVersion(pinnedName)
-			c := b.Cursor()
-			c.Seek(append(pinnedC, 0xff))
-			k, pv := c.Prev()
-
-			if k != nil && strings.HasPrefix(string(pv[32+8:]), pinnedName+".") {
-				n = i.pkgIno(pv)
-				_, err := i.getPkgTx(tx, n, pv[:32])
-				if err != nil {
-					return err
-				}
-				return nil
-			}
-
-			// Pinned version not found — log warning and fall through to unpinned
-			log.Printf("apkgdb: warning: pinned version %q for %q not found, falling back to latest", pin, name)
-		}
+	return
+}
 
-		// Find latest version via prefix seek
+// resolveTx finds the package name resolves to, honouring the pins of
+// channel ch and version constraints, and returns its p2p value. exact is true if name is the
+// full name of the package. Must be called within a bolt View transaction
+// with the read lock held.
+func (i *DB) resolveTx(tx *bolt.Tx, ch, name string) (v []byte, exact bool, err error) {
+	if family, expr, ok := strings.Cut(name, "@"); ok {
+		v, err = i.resolveConstraintTx(tx, ch, family, expr)
+		return v, false, err
+	}
+
+	b := tx.Bucket([]byte("p2p"))
+	if b == nil {
+		return nil, false, os.ErrNotExist
+	}
+
+	nameC := collatedVersion(name)
+
+	v = b.Get(nameC)
+	if v != nil {
+		return v, true, nil
+	}
+
+	// Check for a version pin on the channel
+	if pin := i.lookupPinTx(tx, ch, name); pin != "" {
+		// Constrain the cursor seek to the pinned version prefix
+		pinnedName := name + "." + pin
+		pinnedC := collatedVersion(pinnedName)
 		c := b.Cursor()
-		c.Seek(append(nameC, 0xff))
-		k, v := c.Prev()
+		c.Seek(append(pinnedC, 0xff))
+		k, pv := c.Prev()
 
-		if k == nil {
-			return os.ErrNotExist
+		if k != nil && strings.HasPrefix(string(pv[32+8:]), pinnedName+".") {
+			return pv, false, nil
 		}
 
-		// compare name
-		if !strings.HasPrefix(string(v[32+8:]), name+".") {
-			return os.ErrNotExist
-		}
+		// Pinned version not found — log warning and fall through to unpinned
+		log.Printf("apkgdb: warning: pinned version %q for %q not found, falling back to latest", pin, name)
+	}
 
-		n = i.pkgIno(v)
-		// we need to instanciate pkg at this point
-		_, err := i.getPkgTx(tx, n, v[:32])
-		if err != nil {
-			return err
-		}
+	// Find latest version via prefix seek
+	c := b.Cursor()
+	c.Seek(append(nameC, 0xff))
+	k, v := c.Prev()
 
-		return nil
-	})
+	if k == nil {
+		return nil, false, os.ErrNotExist
+	}
 
-	return
+	// compare name
+	if !strings.HasPrefix(string(v[32+8:]), name+".") {
+		return nil, false, os.ErrNotExist
+	}
+
+	return v, false, nil
 }
 
 func (i *DB) pkgIno(pkg []byte) uint64 {
@@ -211,46 +229,94 @@ func (i *DB) pkgInoUnsigned(p *unsignedPkg) (uint64, error) {
 	atomic.StoreUint64(&p.startIno, v)
 	p.squash.SetInodeOffset(v)
 
-	if i.parent != nil {
-		i.parent.ino.ReplaceOrInsert(p)
-	} else {
-		i.ino.ReplaceOrInsert(p)
-	}
+	i.inoInsert(p)
 
 	return v, nil
 }
 
 // GetInode returns the filesystem inode for the given inode number.
-// Special inodes: 1 = root directory, 2 = ld.so.cache.
+// Special inodes: 1 = root directory, 2 = ld.so.cache, 3 = .virtual.
 func (d *DB) GetInode(reqino uint64) (apkgfs.Inode, error) {
-	var val pkgindexItem
-
 	switch reqino {
 	case 1: // root
 		// shouldn't happen
 		return d, nil
 	case 2: // ld.so.cache
+		d.ldsoLk.Lock()
+		defer d.ldsoLk.Unlock()
 		return &ldsoIno{d: d, ldso: d.ldso}, nil
+	case 3: // .virtual
+		return virtualRoot{d: d}, nil
+	}
+
+	switch pkg := d.pkgByIno(reqino).(type) {
+	case *Package:
+		return pkg.handleLookup(reqino)
+	case *unsignedPkg:
+		return pkg.handleLookup(reqino)
+	case *virtualView:
+		return pkg.handleLookup(reqino)
 	}
 
+	return nil, os.ErrInvalid
+}
+
+// pkgByIno returns the loaded package the given inode belongs to, or nil.
+func (d *DB) pkgByIno(reqino uint64) pkgindexItem {
+	if d.parent != nil {
+		// packages of sub databases are indexed in the parent
+		return d.parent.pkgByIno(reqino)
+	}
+
+	var val pkgindexItem
+
 	// check if we have this in loaded cache
+	d.inoLk.RLock()
 	d.ino.DescendLessOrEqual(pkgindex(reqino), func(i llrb.Item) bool {
 		val = i.(pkgindexItem)
 		return false
 	})
+	d.inoLk.RUnlock()
 
 	switch pkg := val.(type) {
 	case *Package:
 		if pkg != nil && reqino < pkg.startIno+pkg.inodes+1 {
-			return pkg.handleLookup(reqino)
+			return pkg
 		}
 	case *unsignedPkg:
 		if pkg != nil && reqino < pkg.startIno+pkg.inodes+1 {
-			return pkg.handleLookup(reqino)
+			return pkg
+		}
+	case *virtualView:
+		if pkg != nil && reqino < pkg.startIno+pkg.inodes {
+			return pkg
 		}
 	}
 
-	return nil, os.ErrInvalid
+	return nil
+}
+
+// inoInsert adds a package to the inode index. Packages of sub databases
+// are indexed in the parent.
+func (d *DB) inoInsert(item pkgindexItem) {
+	if d.parent != nil {
+		d.parent.inoInsert(item)
+		return
+	}
+	d.inoLk.Lock()
+	defer d.inoLk.Unlock()
+	d.ino.ReplaceOrInsert(item)
+}
+
+// inoDelete removes a package from the inode index.
+func (d *DB) inoDelete(item pkgindexItem) {
+	if d.parent != nil {
+		d.parent.inoDelete(item)
+		return
+	}
+	d.inoLk.Lock()
+	defer d.inoLk.Unlock()
+	d.ino.Delete(item)
 }
 
 func (d *DB) nextInode() (n uint64) {
@@ -28,6 +28,7 @@ type PackageMeta struct {
 	Inodes    uint32                       `json:"inodes"`
 	LDSO      []byte                       `json:"ld.so.cache,omitempty"` // optional ld.so.cache file, as base64
 	Provides  map[string]*PackageMetaFile  `json:"provides"`
+	Needed    []string                     `json:"needed,omitempty"` // sonames needed by the package's ELF files and not provided by it
 	Size      int64                        `json:"size"`
 	Virtual   map[string]map[string]string `json:"virtual,omitempty"`
 	Created   []int64                      `json:"created"`
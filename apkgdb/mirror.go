@@ -0,0 +1,251 @@
+package apkgdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirror failures cause the mirror to be avoided for an increasing amount of
+// time, up to mirrorMaxBackoff
+const (
+	mirrorBackoff    = 30 * time.Second
+	mirrorMaxBackoff = time.Hour
+)
+
+// mirrorStall is how long a response body may go without any data before the
+// download is aborted and the mirror marked as failing.
+var mirrorStall = 30 * time.Second
+
+var (
+	// mirrors by prefix, so their health is shared by all the databases
+	// using them, such as sub databases
+	knownMirrors = make(map[string]*mirror)
+	mirrorLk     sync.Mutex // protects knownMirrors and the state of mirrors
+)
+
+type mirror struct {
+	prefix  string
+	fails   int       // consecutive failures
+	retry   time.Time // avoid this mirror until then
+	lastErr string
+}
+
+// MirrorStatus describes the health of one of the database's mirrors.
+type MirrorStatus struct {
+	Prefix    string    `json:"prefix"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	RetryAt   time.Time `json:"retry_at,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// mirrorList is an ordered list of URL prefixes data can be fetched from.
+// Since both databases and packages are signed, mirrors do not need to be
+// trusted.
+type mirrorList struct {
+	list []*mirror
+}
+
+// parseMirrors parses a comma separated list of URL prefixes
+func parseMirrors(prefix string) *mirrorList {
+	res := &mirrorList{}
+
+	for _, p := range strings.Split(prefix, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+
+		mirrorLk.Lock()
+		mi, ok := knownMirrors[p]
+		if !ok {
+			mi = &mirror{prefix: p}
+			knownMirrors[p] = mi
+		}
+		mirrorLk.Unlock()
+		res.list = append(res.list, mi)
+	}
+
+	return res
+}
+
+// order returns the mirrors in the order they should be tried: healthy
+// mirrors first in configured order, then failing ones by retry time.
+func (m *mirrorList) order() []*mirror {
+	mirrorLk.Lock()
+	defer mirrorLk.Unlock()
+
+	now := time.Now()
+	res := make([]*mirror, len(m.list))
+	copy(res, m.list)
+
+	sort.SliceStable(res, func(i, j int) bool {
+		iok := !res[i].retry.After(now)
+		jok := !res[j].retry.After(now)
+		if iok || jok {
+			return iok && !jok
+		}
+		return res[i].retry.Before(res[j].retry)
+	})
+	return res
+}
+
+// best returns the mirror that should be tried first, or nil if there are no
+// mirrors.
+func (m *mirrorList) best() *mirror {
+	if res := m.order(); len(res) > 0 {
+		return res[0]
+	}
+	return nil
+}
+
+func (m *mirrorList) success(mi *mirror) {
+	mirrorLk.Lock()
+	defer mirrorLk.Unlock()
+
+	mi.fails = 0
+	mi.retry = time.Time{}
+}
+
+func (m *mirrorList) failure(mi *mirror, err error) {
+	mirrorLk.Lock()
+	defer mirrorLk.Unlock()
+
+	backoff := mirrorBackoff << min(mi.fails, 7)
+	if backoff > mirrorMaxBackoff {
+		backoff = mirrorMaxBackoff
+	}
+	mi.fails += 1
+	mi.retry = time.Now().Add(backoff)
+	mi.lastErr = err.Error()
+
+	log.Printf("apkgdb: mirror %s failed (%s), avoiding it for %s", mi.prefix, err, backoff)
+}
+
+func (m *mirrorList) status() []MirrorStatus {
+	mirrorLk.Lock()
+	defer mirrorLk.Unlock()
+
+	now := time.Now()
+	res := make([]MirrorStatus, 0, len(m.list))
+	for _, mi := range m.list {
+		st := MirrorStatus{
+			Prefix:    mi.prefix,
+			Healthy:   !mi.retry.After(now),
+			Failures:  mi.fails,
+			LastError: mi.lastErr,
+		}
+		if !st.Healthy {
+			st.RetryAt = mi.retry
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// get performs a GET request for the given path on each mirror in turn,
+// until one answers. Network errors and 5xx responses cause the next mirror
+// to be tried, as well as 404 responses for files other than LATEST.jwt,
+// which never change once published and may not have reached all mirrors
+// yet. Any other response is returned as is. Reading the body fails if no
+// data is received for mirrorStall, and the mirror is then marked as failing.
+func (m *mirrorList) get(p string, hdr http.Header) (*http.Response, error) {
+	var lastErr error = errors.New("no mirror available")
+	var notFound *http.Response
+	immutable := path.Base(p) != "LATEST.jwt"
+
+	for _, mi := range m.order() {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, "GET", mi.prefix+p, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+
+		resp, err := hClient.Do(req)
+		if err != nil {
+			cancel()
+			m.failure(mi, err)
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			cancel()
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			m.failure(mi, lastErr)
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound && immutable {
+			if notFound != nil {
+				notFound.Body.Close()
+			}
+			resp.Body = &stallReader{ReadCloser: resp.Body, cancel: cancel}
+			notFound = resp
+			continue
+		}
+		if notFound != nil {
+			notFound.Body.Close()
+		}
+
+		m.success(mi)
+		r := &stallReader{ReadCloser: resp.Body, cancel: cancel}
+		r.timer = time.AfterFunc(mirrorStall, func() {
+			m.failure(mi, errors.New("download stalled"))
+			cancel()
+		})
+		resp.Body = r
+		return resp, nil
+	}
+
+	if notFound != nil {
+		return notFound, nil
+	}
+	return nil, lastErr
+}
+
+// stallReader is the body of a response from a mirror. It aborts the request
+// when no data was received for mirrorStall.
+type stallReader struct {
+	io.ReadCloser
+	timer  *time.Timer // nil if there is no deadline
+	cancel context.CancelFunc
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(mirrorStall)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// Mirrors returns the health status of the database's mirrors, in the
+// configured order.
+func (d *DB) Mirrors() []MirrorStatus {
+	return d.mirrors.status()
+}
@@ -0,0 +1,173 @@
+package apkgdb
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMirrors(t *testing.T) {
+	m := parseMirrors("https://a.example/, https://b.example,,")
+	if len(m.list) != 2 {
+		t.Fatalf("expected 2 mirrors, got %d", len(m.list))
+	}
+	if m.list[0].prefix != "https://a.example/" || m.list[1].prefix != "https://b.example/" {
+		t.Errorf("unexpected prefixes %q, %q", m.list[0].prefix, m.list[1].prefix)
+	}
+
+	if parseMirrors("").best() != nil {
+		t.Errorf("expected no mirror for empty prefix")
+	}
+}
+
+func TestMirrorOrder(t *testing.T) {
+	m := parseMirrors("https://a.example/,https://b.example/,https://c.example/")
+	a, b, c := m.list[0], m.list[1], m.list[2]
+
+	m.failure(a, errors.New("test"))
+	m.failure(b, errors.New("test"))
+	m.failure(b, errors.New("test"))
+
+	order := m.order()
+	if order[0] != c || order[1] != a || order[2] != b {
+		t.Errorf("expected c, a, b; got %s, %s, %s", order[0].prefix, order[1].prefix, order[2].prefix)
+	}
+
+	m.success(a)
+	if m.best() != a {
+		t.Errorf("expected a to be back first after success")
+	}
+
+	st := m.status()
+	if !st[0].Healthy || st[1].Healthy || st[1].Failures != 2 || st[1].LastError != "test" {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestMirrorGetFailover(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/db/main/LATEST.jwt" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "NEW")
+	}))
+	defer good.Close()
+
+	m := parseMirrors(bad.URL + "," + good.URL)
+
+	resp, err := m.get("db/main/LATEST.jwt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "NEW" {
+		t.Errorf("expected response from good mirror, got %q", body)
+	}
+
+	if m.best().prefix != good.URL+"/" {
+		t.Errorf("expected failing mirror to be moved back")
+	}
+
+	// 404 is not a mirror failure
+	resp, err = m.get("db/main/missing.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %s", resp.Status)
+	}
+	if m.best().prefix != good.URL+"/" {
+		t.Errorf("404 should not mark mirror as failing")
+	}
+}
+
+func TestMirrorGetNotFound(t *testing.T) {
+	stale := httptest.NewServer(http.NotFoundHandler())
+	defer stale.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	}))
+	defer good.Close()
+
+	m := parseMirrors(stale.URL + "," + good.URL)
+
+	// the stale mirror does not have the new database yet
+	resp, err := m.get("db/main/linux/amd64/20250101000000.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "data" {
+		t.Errorf("expected response from the up to date mirror, got %d %q", resp.StatusCode, body)
+	}
+
+	// but LATEST.jwt tells which version the mirror has
+	resp, err = m.get("db/main/linux/amd64/LATEST.jwt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 from the first mirror, got %s", resp.Status)
+	}
+	if m.best().prefix != stale.URL+"/" {
+		t.Errorf("404 should not mark mirror as failing")
+	}
+}
+
+func TestMirrorGetStall(t *testing.T) {
+	defer func(v time.Duration) { mirrorStall = v }(mirrorStall)
+	mirrorStall = 100 * time.Millisecond
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	m := parseMirrors(srv.URL)
+	resp, err := m.get("db/main/linux/amd64/20250101000000.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected stalled download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled download was not aborted")
+	}
+
+	// sub databases use the same mirrors, and see it failing
+	if st := parseMirrors(srv.URL).status(); st[0].Healthy {
+		t.Error("stalled mirror should be marked as failing")
+	}
+}
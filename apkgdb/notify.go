@@ -6,6 +6,13 @@ type NotifyTarget interface {
 	NotifyInode(ino uint64, offt int64, data []byte) error
 }
 
+// InodeTracker can be implemented by a NotifyTarget able to tell whether
+// the kernel still holds references to inodes. It is used to know which
+// packages can be evicted from the local cache.
+type InodeTracker interface {
+	InodesInUse(start, end uint64) bool
+}
+
 func (db *DB) notifyInode(ino uint64, offt int64, data []byte) error {
 	for {
 		if v := db.ntgt.Load(); v != nil {
@@ -21,5 +28,59 @@ func (db *DB) notifyInode(ino uint64, offt int64, data []byte) error {
 
 // SetNotifyTarget sets the notification target for inode changes.
 func (db *DB) SetNotifyTarget(tgt NotifyTarget) {
-	db.ntgt.Store(tgt)
+	db.ntgtLk.Lock()
+	defer db.ntgtLk.Unlock()
+	db.ntgt.Store(notifyTargets{tgt})
+}
+
+// AddNotifyTarget adds a notification target, for databases served by more
+// than one filesystem.
+func (db *DB) AddNotifyTarget(tgt NotifyTarget) {
+	db.ntgtLk.Lock()
+	defer db.ntgtLk.Unlock()
+	var cur notifyTargets
+	if v := db.ntgt.Load(); v != nil {
+		cur = v.(notifyTargets)
+	}
+	db.ntgt.Store(append(cur[:len(cur):len(cur)], tgt))
+}
+
+// notifyTargets forwards notifications to several targets
+type notifyTargets []NotifyTarget
+
+func (t notifyTargets) NotifyInode(ino uint64, offt int64, data []byte) error {
+	var res error
+	for _, tgt := range t {
+		if err := tgt.NotifyInode(ino, offt, data); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// InodesInUse returns true if the inodes are in use in any of the targets
+func (t notifyTargets) InodesInUse(start, end uint64) bool {
+	for _, tgt := range t {
+		if tr, ok := tgt.(InodeTracker); !ok || tr.InodesInUse(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// inodesInUse returns true if any inode between start and end (inclusive)
+// is referenced. If this cannot be known, inodes are assumed to be in use.
+func (db *DB) inodesInUse(start, end uint64) bool {
+	for {
+		if v := db.ntgt.Load(); v != nil {
+			if t, ok := v.(InodeTracker); ok {
+				return t.InodesInUse(start, end)
+			}
+			return true
+		}
+		db = db.parent
+		if db == nil {
+			return true
+		}
+	}
 }
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -14,6 +15,8 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/AzusaOS/apkg/apkgfs"
@@ -52,13 +55,22 @@ type Package struct {
 	// from file
 	flags   uint64
 	created time.Time
+	sigKey  string // key the package was signed with, see recheckRevoked
 
 	dlMu      sync.Mutex
 	dlDone    bool
+	fLk       sync.RWMutex // protects f & mirror when switching mirrors
 	f         *smartremote.File
-	offset    int64 // offset of data in file
+	mirror    *mirror      // mirror f is downloaded from
+	atime     atomic.Int64 // last access, for cache eviction
+	looked    atomic.Int64 // last lookup resolving to the package, see release
+	offset    int64        // offset of data in file
 	blockSize int64
 	squash    *squashfs.Superblock
+
+	blocks []byte   // signed hash table (sha256 of each data block)
+	blkOk  []uint64 // bitmap of blocks that passed hash check
+	blkLk  sync.Mutex
 }
 
 type pkgindex uint64
@@ -84,23 +96,25 @@ func (p *Package) Value() uint64 {
 	return p.startIno
 }
 
-var (
-	// TODO move to inside DB
-	pkgCache  = make(map[[32]byte]*Package)
-	pkgCacheL sync.RWMutex
-)
+// pkgKey identifies a loaded package in the cache of the root database. The
+// same package may be loaded by several databases, each with its own inodes.
+type pkgKey struct {
+	db   *DB
+	hash [32]byte
+}
 
 func (d *DB) getPkgTx(tx *bolt.Tx, startIno uint64, hash []byte) (*Package, error) {
-	var hashB [32]byte
-	copy(hashB[:], hash)
+	key := pkgKey{db: d}
+	copy(key.hash[:], hash)
+	root := d.cacheRoot()
 
 	// load a package based on its hash (from within a bolt transaction)
-	pkgCacheL.RLock()
-	if v, ok := pkgCache[hashB]; ok {
-		pkgCacheL.RUnlock()
+	root.pkgCacheL.RLock()
+	if v, ok := root.pkgCache[key]; ok {
+		root.pkgCacheL.RUnlock()
 		return v, nil
 	}
-	pkgCacheL.RUnlock()
+	root.pkgCacheL.RUnlock()
 
 	b := tx.Bucket([]byte("pkg"))
 	if b == nil {
@@ -135,21 +149,28 @@ func (d *DB) getPkgTx(tx *bolt.Tx, startIno uint64, hash []byte) (*Package, erro
 	pkg.rawMeta = bytesDup(metaB.Get(hash))
 
 	// keep pkg in cache
-	pkgCacheL.Lock()
-	defer pkgCacheL.Unlock()
-	if v, ok := pkgCache[hashB]; ok {
+	root.pkgCacheL.Lock()
+	defer root.pkgCacheL.Unlock()
+	if v, ok := root.pkgCache[key]; ok {
 		return v, nil
 	}
-	pkgCache[hashB] = pkg
-
-	if d.parent != nil {
-		d.parent.ino.ReplaceOrInsert(pkg)
-	} else {
-		d.ino.ReplaceOrInsert(pkg)
+	if root.pkgCache == nil {
+		root.pkgCache = make(map[pkgKey]*Package)
 	}
+	if root.pkgPaths == nil {
+		root.pkgPaths = make(map[string]*Package)
+	}
+	root.pkgCache[key] = pkg
+	root.pkgPaths[pkg.lpath()] = pkg
+
+	d.inoInsert(pkg)
 
 	log.Printf("apkgdb: spawned package %s (hash=%s)", pkg.name, hex.EncodeToString(hash))
 
+	if d.prefetchNeeded.Load() {
+		go d.prefetchNeededLibs(pkg)
+	}
+
 	// * pkg → package hash → package info (0 + size + inode num + inode count + package name)
 	return pkg, nil
 }
@@ -243,7 +264,7 @@ func OpenPackage(f *os.File) (*Package, error) {
 	}
 	p.rawSig = sig
 
-	_, err = apkgsig.VerifyPkg(header, bytes.NewReader(sig))
+	sigV, err := apkgsig.VerifyPkg(header, bytes.NewReader(sig))
 	if err != nil {
 		return nil, err
 	}
@@ -285,6 +306,10 @@ func OpenPackage(f *os.File) (*Package, error) {
 	p.name = meta.FullName
 	p.inodes = meta.Inodes
 
+	if !sigV.Allows(p.name) {
+		return nil, fmt.Errorf("package %s signed by %s, which is not trusted for this name", p.name, sigV.Name)
+	}
+
 	return p, nil
 }
 
@@ -293,9 +318,10 @@ func (p *Package) handleLookup(ino uint64) (apkgfs.Inode, error) {
 		return apkgfs.NewSymlink([]byte(p.name)), nil
 	}
 
-	p.ensureDl()
+	p.atime.Store(time.Now().UnixNano())
+	squash := p.ensureDl()
 
-	if p.squash == nil {
+	if squash == nil {
 		// problem
 		return nil, os.ErrInvalid
 	}
@@ -305,19 +331,24 @@ func (p *Package) handleLookup(ino uint64) (apkgfs.Inode, error) {
 		return nil, os.ErrInvalid
 	}
 
-	return p.squash.GetInode(ino - p.startIno)
+	return squash.GetInode(ino - p.startIno)
 }
 
-func (p *Package) ensureDl() {
+// ensureDl downloads the package if needed and returns its filesystem, or nil
+// if it could not be loaded. The filesystem may be unloaded by the cache at
+// any time after dlMu is released, so p.squash must not be used directly.
+func (p *Package) ensureDl() *squashfs.Superblock {
 	p.dlMu.Lock()
 	defer p.dlMu.Unlock()
 	if p.dlDone {
-		return
+		return p.squash
 	}
 	p.doDl()
 	if p.squash != nil {
 		p.dlDone = true
+		go p.parent.cacheAdd(p.lpath())
 	}
+	return p.squash
 }
 
 func (p *Package) doDl() {
@@ -331,17 +362,18 @@ func (p *Package) doDl() {
 	}
 
 	// download this package
-	// need to replace "+" with "%2B" for S3
-	u := p.parent.prefix + "dist/" + p.parent.name + "/" + strings.ReplaceAll(p.path, "+", "%2B")
-
-	f, err := smartremote.DefaultDownloadManager.OpenTo(u, lpath)
+	mi := p.parent.mirrors.best()
+	if mi == nil {
+		log.Printf("apkgdb: failed to get package %s: no mirror available", p.name)
+		return
+	}
+	p.fLk.Lock()
+	err = p.openFile(mi)
+	p.fLk.Unlock()
 	if err != nil {
 		log.Printf("apkgdb: failed to get package: %s", err)
 		return
 	}
-	f.SetSize(int64(p.size))
-
-	p.f = f
 
 	err = p.validate()
 	if err != nil {
@@ -353,21 +385,126 @@ func (p *Package) doDl() {
 			p.dlDone = false
 			p.dlMu.Unlock()
 		}()
-		defer p.f.Close()
-		p.f = nil
+		p.closeFile()
 		return
 	}
 
 	p.squash, err = squashfs.New(p, squashfs.InodeOffset(p.startIno))
 	if err != nil {
 		log.Printf("apkgdb: failed to mount: %s", err)
-		defer p.f.Close()
-		p.f = nil
+		p.closeFile()
 		p.squash = nil
 		return
 	}
 }
 
+// openFile opens the package's local file, downloading missing data from the
+// given mirror. fLk must be held.
+func (p *Package) openFile(mi *mirror) error {
+	f, err := smartremote.DefaultDownloadManager.OpenTo(mi.prefix+p.remotePath(), p.lpath())
+	if err != nil {
+		return err
+	}
+	f.SetSize(int64(p.size))
+
+	p.f = f
+	p.mirror = mi
+	return nil
+}
+
+// closeFile closes the package's local file, if open.
+func (p *Package) closeFile() {
+	p.fLk.Lock()
+	defer p.fLk.Unlock()
+
+	if p.f != nil {
+		_ = p.f.Close()
+		p.f = nil
+	}
+}
+
+// readFile reads from the package file. If the read fails while data is
+// being downloaded, the mirror is marked as failing and the read is retried
+// on the next available one, until all mirrors have been tried. If the disk
+// is full, unused packages are evicted from the cache before retrying.
+func (p *Package) readFile(b []byte, off int64) (int, error) {
+	freed := false
+	var tried map[*mirror]bool // mirrors that failed during this read
+	for {
+		p.fLk.RLock()
+		f, mi := p.f, p.mirror
+		if f == nil {
+			p.fLk.RUnlock()
+			return 0, os.ErrInvalid
+		}
+		n, err := f.ReadAt(b, off)
+		p.fLk.RUnlock()
+
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if isNoSpace(err) && !freed {
+			// make some room and retry
+			freed = true
+			p.parent.cacheFree(cacheEnospcFree)
+			continue
+		}
+		if tried == nil {
+			tried = make(map[*mirror]bool)
+		}
+		tried[mi] = true
+		if !p.switchMirror(f, mi, err, tried) {
+			return n, err
+		}
+	}
+}
+
+// switchMirror replaces f, which failed with the given error, with a file
+// downloading from the best mirror not in tried. It returns false if there
+// is no other mirror to try.
+func (p *Package) switchMirror(f *smartremote.File, mi *mirror, err error, tried map[*mirror]bool) bool {
+	p.fLk.Lock()
+	defer p.fLk.Unlock()
+
+	if p.f != f {
+		// already switched by another reader
+		return true
+	}
+
+	p.parent.mirrors.failure(mi, err)
+
+	// once all mirrors are failing, best() returns the one to be retried
+	// first, which may well have failed for this read already
+	var next *mirror
+	for _, c := range p.parent.mirrors.order() {
+		if !tried[c] {
+			next = c
+			break
+		}
+	}
+	if next == nil {
+		return false
+	}
+
+	log.Printf("apkgdb: %s: switching download to mirror %s", p.name, next.prefix)
+
+	// closing will save the .part file, so download resumes where it was
+	_ = f.Close()
+	p.f = nil
+
+	if err := p.openFile(next); err != nil {
+		log.Printf("apkgdb: %s: failed to reopen package: %s", p.name, err)
+		return false
+	}
+	return true
+}
+
+// remotePath returns the path of the package relative to a mirror's prefix.
+func (p *Package) remotePath() string {
+	// need to replace "+" with "%2B" for S3
+	return "dist/" + p.parent.name + "/" + strings.ReplaceAll(p.path, "+", "%2B")
+}
+
 func (p *Package) lpath() string {
 	return filepath.Join(p.parent.path, p.parent.name, p.path)
 }
@@ -375,7 +512,7 @@ func (p *Package) lpath() string {
 func (p *Package) validate() error {
 	// read header, check file
 	header := make([]byte, 124)
-	_, err := p.f.ReadAt(header, 0)
+	_, err := p.readFile(header, 0)
 	if err != nil {
 		return err
 	}
@@ -447,42 +584,197 @@ func (p *Package) validate() error {
 
 	// check signature
 	sig := make([]byte, 128)
-	_, err = p.f.ReadAt(sig, int64(last_offt[0]))
+	_, err = p.readFile(sig, int64(last_offt[0]))
 	if err != nil {
 		return err
 	}
-	_, err = apkgsig.VerifyPkg(header, bytes.NewReader(sig))
+	sigV, err := apkgsig.VerifyPkg(header, bytes.NewReader(sig))
 	if err != nil {
 		return err
 	}
+	if !sigV.Allows(p.name) {
+		return fmt.Errorf("package %s signed by %s, which is not trusted for this name", p.name, sigV.Name)
+	}
+	if !apkgsig.AllowedSigner(sigV.Name, p.parent.signers) {
+		return fmt.Errorf("package %s signed by %s, which is not trusted for database %s", p.name, sigV.Name, p.parent.name)
+	}
+	if err := p.parent.checkRevoked(sigV.Key, p.created); err != nil {
+		return err
+	}
+	p.sigKey = sigV.Key
 	//log.Printf("apkgdb: verified package signature, signed by %s", sigV.Name)
 
-	// TODO store all that stuff
+	// read hash table, its hash is part of the signed header
+	ht := make([]byte, table[1])
+	_, err = p.readFile(ht, int64(table[0]))
+	if err != nil {
+		return err
+	}
+	hth := sha256.Sum256(ht)
+	if !bytes.Equal(hth[:], table_hash) {
+		// make sure we fetch it again next time
+		_ = p.invalidateRange(int64(table[0]), int64(table[0])+int64(table[1]))
+		return errors.New("corrupted hash table")
+	}
 
 	p.offset = int64(last_offt[1])
 	p.blockSize = int64(last_offt[2])
 
+	if p.blockSize <= 0 || len(ht)%32 != 0 {
+		return errors.New("invalid hash table")
+	}
+	if int64(len(ht)/32)*p.blockSize < int64(p.size)-p.offset {
+		return errors.New("hash table does not cover package data")
+	}
+	p.setHashTable(ht)
+
+	return nil
+}
+
+// setHashTable sets the block hash table used to check data read from the
+// package, and resets the list of verified blocks.
+func (p *Package) setHashTable(ht []byte) {
+	p.blkLk.Lock()
+	defer p.blkLk.Unlock()
+
+	p.blocks = ht
+	p.blkOk = make([]uint64, (len(ht)/32+63)/64)
+}
+
+func (p *Package) blockVerified(blk int64) bool {
+	p.blkLk.Lock()
+	defer p.blkLk.Unlock()
+
+	return p.blkOk[blk/64]&(1<<(blk%64)) != 0
+}
+
+// verifyBlocks checks the data blocks covering n bytes at off against the
+// signed hash table. Blocks failing the check are fetched again once, and
+// syscall.EIO is returned if the data still does not match.
+func (p *Package) verifyBlocks(off, n int64) error {
+	dataLen := int64(p.size) - p.offset
+	end := off + n
+	if end > dataLen {
+		end = dataLen
+	}
+
+	for blk := off / p.blockSize; blk*p.blockSize < end; blk++ {
+		if int(blk+1)*32 > len(p.blocks) {
+			// not covered by hash table, shouldn't happen since validate() checks that
+			return syscall.EIO
+		}
+		if p.blockVerified(blk) {
+			continue
+		}
+		if err := p.verifyBlock(blk, dataLen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Package) verifyBlock(blk, dataLen int64) error {
+	start := blk * p.blockSize
+	end := start + p.blockSize
+	if end > dataLen {
+		end = dataLen
+	}
+	buf := make([]byte, end-start)
+
+	n, err := p.readFile(buf, p.offset+start)
+	if err != nil && !(err == io.EOF && n == len(buf)) {
+		return err
+	}
+
+	if !p.checkBlock(blk, buf) {
+		log.Printf("apkgdb: %s: block %d failed hash check, fetching it again", p.name, blk)
+		if err := p.refetchBlock(blk, p.offset+start, buf); err != nil {
+			log.Printf("apkgdb: %s: failed to fetch block %d: %s", p.name, blk, err)
+			return syscall.EIO
+		}
+	}
+
+	p.blkLk.Lock()
+	p.blkOk[blk/64] |= 1 << (blk % 64)
+	p.blkLk.Unlock()
+	return nil
+}
+
+func (p *Package) checkBlock(blk int64, buf []byte) bool {
+	h := sha256.Sum256(buf)
+	return bytes.Equal(h[:], p.blocks[blk*32:blk*32+32])
+}
+
+// refetchBlock marks a block as missing in the local copy of the package and
+// reads it again, which downloads it from the mirrors.
+func (p *Package) refetchBlock(blk, pos int64, buf []byte) error {
+	if err := p.invalidateRange(pos, pos+int64(len(buf))); err != nil {
+		return err
+	}
+
+	n, err := p.readFile(buf, pos)
+	if err != nil && !(err == io.EOF && n == len(buf)) {
+		return err
+	}
+	if !p.checkBlock(blk, buf) {
+		return errors.New("downloaded block does not match hash table")
+	}
 	return nil
 }
 
+// invalidateRange marks the range [start, end) of the package file as not
+// downloaded. smartremote opens a complete file read-only and without download
+// status, so invalidating a range of it marks the whole file as missing: it is
+// reopened to download data again, and all blocks are checked again.
+func (p *Package) invalidateRange(start, end int64) error {
+	p.fLk.Lock()
+	defer p.fLk.Unlock()
+
+	if p.f == nil {
+		return os.ErrInvalid
+	}
+
+	_, partErr := os.Stat(p.lpath() + ".part")
+	if err := p.f.InvalidateRange(start, end); err != nil {
+		return err
+	}
+	if partErr == nil {
+		return nil
+	}
+
+	// closing saves the .part file written by InvalidateRange
+	_ = p.f.Close()
+	p.f = nil
+
+	p.blkLk.Lock()
+	clear(p.blkOk)
+	p.blkLk.Unlock()
+
+	return p.openFile(p.mirror)
+}
+
 // Meta unmarshals the package's JSON metadata into the provided value.
 func (p *Package) Meta(v interface{}) error {
 	return json.Unmarshal(p.rawMeta, v)
 }
 
 // ReadAt implements io.ReaderAt for reading package data at a specific offset.
-// The offset is relative to the data section of the package file.
+// The offset is relative to the data section of the package file. Data is
+// checked against the package's signed block hash table before being returned.
 func (p *Package) ReadAt(b []byte, off int64) (int, error) {
-	if p.f == nil {
+	p.fLk.RLock()
+	f := p.f
+	p.fLk.RUnlock()
+	if f == nil || off < 0 {
 		return 0, os.ErrInvalid // should return E_IO
 	}
 	//log.Printf("converted read = %d", off+p.offset)
-	// we need to align offset to lower blockSize, and size to higher blockSize
-	/*
-		offDelta = p.blockSize - (off % p.blockSize)
-		if offDelta == p.blockSize {
-			offDelta = 0
-		}*/
-
-	return p.f.ReadAt(b, off+p.offset)
+	p.atime.Store(time.Now().UnixNano())
+
+	// make sure all the blocks we are about to read match the hash table
+	if err := p.verifyBlocks(off, int64(len(b))); err != nil {
+		return 0, err
+	}
+
+	return p.readFile(b, off+p.offset)
 }
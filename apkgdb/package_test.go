@@ -1,10 +1,17 @@
 package apkgdb
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -78,3 +85,171 @@ func TestGetPkgTxMissingPkgBucket(t *testing.T) {
 		t.Errorf("expected os.ErrInvalid for missing pkg bucket, got %v", err)
 	}
 }
+
+// newTestBlockPackage returns a package reading from a local file containing
+// local, with good being served as the remote copy of the file.
+func newTestBlockPackage(t *testing.T, local, good []byte) *Package {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "pkg.apkg", time.Time{}, bytes.NewReader(good))
+	}))
+	t.Cleanup(srv.Close)
+
+	p := &Package{
+		parent:    &DB{path: t.TempDir(), name: "test", mirrors: parseMirrors(srv.URL)},
+		name:      "test",
+		path:      "pkg.apkg",
+		size:      uint64(len(good)),
+		blockSize: 4096,
+	}
+
+	// a file without .part is considered complete by smartremote
+	lpath := p.lpath()
+	if err := os.MkdirAll(filepath.Dir(lpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lpath, local, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.openFile(p.parent.mirrors.best()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.f.Close() })
+
+	var ht []byte
+	for i := 0; i < len(good); i += 4096 {
+		h := sha256.Sum256(good[i:min(i+4096, len(good))])
+		ht = append(ht, h[:]...)
+	}
+	p.setHashTable(ht)
+	return p
+}
+
+func TestGetPkgTxPerDatabase(t *testing.T) {
+	// the same package loaded by two databases, such as layered mounts
+	name := "core.zlib.1.3.linux.amd64"
+	var dbs []*DB
+	for i := range 2 {
+		d, cleanup := newTestDB(t)
+		defer cleanup()
+		d.mirrors = parseMirrors("")
+		d.SetInodeBase(uint64(i+1) << 40)
+		addTestPackages(t, d, `{}`, name)
+		dbs = append(dbs, d)
+	}
+
+	for _, d := range dbs {
+		n, err := d.internalLookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, ok := d.pkgByIno(n).(*Package)
+		if !ok || p.parent != d {
+			t.Fatalf("lookup of %s returned inode %d, not a package of the database", name, n)
+		}
+		if _, err := d.GetInode(p.startIno); err != nil {
+			t.Errorf("GetInode(%d): %s", p.startIno, err)
+		}
+	}
+}
+
+func TestReadAtRefetchesCorruptedBlock(t *testing.T) {
+	good := make([]byte, 3*4096+100)
+	for i := range good {
+		good[i] = byte(i * 7)
+	}
+	bad := bytes.Clone(good)
+	bad[4096+50] ^= 0xff
+
+	p := newTestBlockPackage(t, bad, good)
+
+	buf := make([]byte, 200)
+	n, err := p.ReadAt(buf, 4096)
+	if err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], good[4096:4096+200]) {
+		t.Error("ReadAt returned corrupted data")
+	}
+
+	// local copy should have been repaired
+	local, err := os.ReadFile(p.lpath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local, good) {
+		t.Error("local copy was not repaired")
+	}
+}
+
+func TestReadAtFailsOnBadRemote(t *testing.T) {
+	good := make([]byte, 2*4096)
+	bad := bytes.Clone(good)
+	bad[10] = 1
+
+	// both local and remote copies are bad, hash table is for good
+	p := newTestBlockPackage(t, bad, bad)
+	ht := p.blocks
+	h := sha256.Sum256(good[:4096])
+	copy(ht, h[:])
+	p.setHashTable(ht)
+
+	buf := make([]byte, 100)
+	if _, err := p.ReadAt(buf, 0); err != syscall.EIO {
+		t.Errorf("expected EIO, got %v", err)
+	}
+
+	// second block is fine
+	if _, err := p.ReadAt(buf, 4096); err != nil {
+		t.Errorf("unexpected error reading valid block: %v", err)
+	}
+}
+
+func TestReadFileAllMirrorsFailing(t *testing.T) {
+	var calls atomic.Int32
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	a := httptest.NewServer(down)
+	defer a.Close()
+	b := httptest.NewServer(down)
+	defer b.Close()
+
+	p := &Package{
+		parent: &DB{path: t.TempDir(), name: "test", mirrors: parseMirrors(a.URL + "," + b.URL)},
+		name:   "test",
+		path:   "pkg.apkg",
+		size:   8192,
+	}
+	if err := os.MkdirAll(filepath.Dir(p.lpath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.openFile(p.parent.mirrors.best()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.closeFile()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.readFile(make([]byte, 100), 0)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error when all mirrors fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("read did not return with all mirrors failing")
+	}
+
+	// both mirrors are now failing, a new read must fail as well
+	if _, err := p.readFile(make([]byte, 100), 0); err == nil {
+		t.Error("expected an error on second read")
+	}
+	if n := calls.Load(); n > 10 {
+		t.Errorf("mirrors were called %d times", n)
+	}
+}
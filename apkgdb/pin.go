@@ -2,6 +2,7 @@ package apkgdb
 
 import (
 	"errors"
+	"strings"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -99,11 +100,45 @@ func (d *DB) ListPins(channel string) map[string]string {
 	return result
 }
 
-// lookupPin checks the active channel's pins for a version pin matching name.
+// AllPins returns the pins of all channels as a map of channel → prefix → version.
+func (d *DB) AllPins() map[string]map[string]string {
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	result := make(map[string]map[string]string)
+	if d.dbptr == nil {
+		return result
+	}
+
+	_ = d.dbptr.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("pins"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ch, prefix, ok := strings.Cut(string(k), "\x00")
+			if !ok {
+				return nil
+			}
+			if result[ch] == nil {
+				result[ch] = make(map[string]string)
+			}
+			result[ch][prefix] = string(v)
+			return nil
+		})
+	})
+	return result
+}
+
+// lookupPin checks the local overrides, then the pins of channel ch for a
+// version pin matching name.
 // Returns the version prefix to constrain lookup, or "" if no pin applies.
 // Must be called within a bolt View transaction with the read lock held.
-func (d *DB) lookupPinTx(tx *bolt.Tx, name string) string {
-	ch := d.channel
+func (d *DB) lookupPinTx(tx *bolt.Tx, ch, name string) string {
+	if v := d.pinOverride(name); v != "" {
+		return v
+	}
+
 	if ch == "" || ch == "latest" {
 		return ""
 	}
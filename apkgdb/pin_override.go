@@ -0,0 +1,121 @@
+package apkgdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Pin overrides are version pins set locally on a host. They take precedence
+// over the pins of the active channel, including the "latest" channel, and
+// are not part of the signed database.
+
+// EffectivePin describes the pin applied to a package prefix and where it
+// comes from, as returned by v1/pins/effective.
+type EffectivePin struct {
+	Prefix    string `json:"prefix"`
+	Version   string `json:"version"`
+	Source    string `json:"source"`              // "local" or "channel"
+	Channel   string `json:"channel,omitempty"`   // channel the pin comes from
+	Overrides string `json:"overrides,omitempty"` // channel pin hidden by a local override
+}
+
+// LoadPinOverrides reads a pin override file. Each line holds a package
+// prefix and a version, separated by spaces, and # starts a comment:
+//
+//	# hold glibc on this build box
+//	sys-libs.glibc 2.40
+//
+// A missing file is not an error and returns no overrides.
+func LoadPinOverrides(fn string) (map[string]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]string)
+	s := bufio.NewScanner(f)
+	ln := 0
+	for s.Scan() {
+		ln += 1
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			res[fields[0]] = fields[1]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected package prefix and version", fn, ln)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SetPinOverrides replaces the local pin overrides (prefix → version) of the
+// database and its sub databases.
+func (d *DB) SetPinOverrides(pins map[string]string) {
+	if len(pins) == 0 {
+		pins = nil
+	}
+	d.overrides.Store(&pins)
+	d.resetVirtual()
+	d.subLk.RLock()
+	for _, sub := range d.sub {
+		sub.SetPinOverrides(pins)
+	}
+	d.subLk.RUnlock()
+}
+
+// PinOverrides returns the local pin overrides as a map of prefix → version.
+func (d *DB) PinOverrides() map[string]string {
+	res := make(map[string]string)
+	if p := d.overrides.Load(); p != nil {
+		for k, v := range *p {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// pinOverride returns the local override for name, or ""
+func (d *DB) pinOverride(name string) string {
+	if p := d.overrides.Load(); p != nil {
+		return (*p)[name]
+	}
+	return ""
+}
+
+// EffectivePins returns the pins used for version resolution, merging the
+// local overrides and the pins of the active channel, sorted by prefix.
+func (d *DB) EffectivePins() []*EffectivePin {
+	pins := make(map[string]*EffectivePin)
+	if ch := d.channel; ch != "" && ch != "latest" {
+		for pfx, v := range d.ListPins(ch) {
+			pins[pfx] = &EffectivePin{Prefix: pfx, Version: v, Source: "channel", Channel: ch}
+		}
+	}
+	for pfx, v := range d.PinOverrides() {
+		p := &EffectivePin{Prefix: pfx, Version: v, Source: "local"}
+		if prev, ok := pins[pfx]; ok {
+			p.Overrides = prev.Version
+		}
+		pins[pfx] = p
+	}
+
+	res := make([]*EffectivePin, 0, len(pins))
+	for _, p := range pins {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Prefix < res[j].Prefix })
+	return res
+}
@@ -0,0 +1,85 @@
+package apkgdb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLoadPinOverrides(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "pins.conf")
+	os.WriteFile(fn, []byte("# build box\nsys-libs.glibc 2.40\n\n  dev-lang.python\t3.12 # hold\n"), 0644)
+
+	pins, err := LoadPinOverrides(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || pins["sys-libs.glibc"] != "2.40" || pins["dev-lang.python"] != "3.12" {
+		t.Errorf("unexpected overrides %v", pins)
+	}
+
+	os.WriteFile(fn, []byte("sys-libs.glibc\n"), 0644)
+	if _, err := LoadPinOverrides(fn); err == nil {
+		t.Error("expected error for line without version")
+	}
+
+	if pins, err := LoadPinOverrides(filepath.Join(t.TempDir(), "missing")); pins != nil || err != nil {
+		t.Errorf("expected no overrides for missing file, got %v %v", pins, err)
+	}
+}
+
+func TestPinOverrideLookup(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	d.SetPin("stable", "sys-libs.glibc", "2.41")
+	d.SetPin("stable", "dev-lang.python", "3.12")
+	d.SetPinOverrides(map[string]string{"sys-libs.glibc": "2.40", "dev-lang.go": "1.24"})
+
+	lookup := func(name string) string {
+		d.dbrw.RLock()
+		defer d.dbrw.RUnlock()
+
+		var result string
+		d.dbptr.View(func(tx *bolt.Tx) error {
+			result = d.lookupPinTx(tx, d.channel, name)
+			return nil
+		})
+		return result
+	}
+
+	for _, ch := range []string{"stable", "latest"} {
+		d.SetChannel(ch)
+		if v := lookup("sys-libs.glibc"); v != "2.40" {
+			t.Errorf("channel %s: expected override 2.40, got %q", ch, v)
+		}
+	}
+	d.SetChannel("stable")
+	if v := lookup("dev-lang.python"); v != "3.12" {
+		t.Errorf("expected channel pin 3.12, got %q", v)
+	}
+
+	var pins []*EffectivePin
+	apiGet(t, d, "/apkgdb/test/v1/pins/effective", http.StatusOK, &pins)
+	want := []EffectivePin{
+		{Prefix: "dev-lang.go", Version: "1.24", Source: "local"},
+		{Prefix: "dev-lang.python", Version: "3.12", Source: "channel", Channel: "stable"},
+		{Prefix: "sys-libs.glibc", Version: "2.40", Source: "local", Overrides: "2.41"},
+	}
+	if len(pins) != len(want) {
+		t.Fatalf("unexpected effective pins %v", pins)
+	}
+	for i := range want {
+		if *pins[i] != want[i] {
+			t.Errorf("effective pin %d: expected %+v, got %+v", i, want[i], *pins[i])
+		}
+	}
+
+	d.SetPinOverrides(nil)
+	if v := lookup("sys-libs.glibc"); v != "2.41" {
+		t.Errorf("expected channel pin after clearing overrides, got %q", v)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/petar/GoLLRB/llrb"
 	bolt "go.etcd.io/bbolt"
@@ -132,7 +133,7 @@ func TestLookupPinTxLatestChannel(t *testing.T) {
 
 	var result string
 	d.dbptr.View(func(tx *bolt.Tx) error {
-		result = d.lookupPinTx(tx, "sys-libs.glibc")
+		result = d.lookupPinTx(tx, d.channel, "sys-libs.glibc")
 		return nil
 	})
 	if result != "" {
@@ -152,7 +153,7 @@ func TestLookupPinTxWithChannel(t *testing.T) {
 
 	var result string
 	d.dbptr.View(func(tx *bolt.Tx) error {
-		result = d.lookupPinTx(tx, "sys-libs.glibc")
+		result = d.lookupPinTx(tx, d.channel, "sys-libs.glibc")
 		return nil
 	})
 	if result != "2.41" {
@@ -171,7 +172,7 @@ func TestLookupPinTxNoPins(t *testing.T) {
 
 	var result string
 	d.dbptr.View(func(tx *bolt.Tx) error {
-		result = d.lookupPinTx(tx, "sys-libs.glibc")
+		result = d.lookupPinTx(tx, d.channel, "sys-libs.glibc")
 		return nil
 	})
 	if result != "" {
@@ -331,6 +332,45 @@ func TestPinnedLookupMissingVersionFallback(t *testing.T) {
 	}
 }
 
+func TestPinRemovedOnUpdate(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	key := newTestExportKey(t)
+
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.40.linux.amd64")
+	if err := d.SetPin("stable", "sys-libs.glibc", "2.40"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+
+	client, cleanup2 := newTestDB(t)
+	defer cleanup2()
+	if err := indexTestFile(client, filepath.Join(d.path, d.CurrentVersion()+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if v := client.GetPin("stable", "sys-libs.glibc"); v != "2.40" {
+		t.Fatalf("expected pin 2.40 on client, got %q", v)
+	}
+
+	// versions have a one second resolution
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	if err := d.DeletePin("stable", "sys-libs.glibc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexTestFile(client, filepath.Join(d.path, d.CurrentVersion()+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if pins := client.AllPins(); len(pins) != 0 {
+		t.Errorf("removed pin still present on client: %v", pins)
+	}
+}
+
 func TestPinKeyFormat(t *testing.T) {
 	k := pinKey("stable", "sys-libs.glibc")
 	expected := "stable\x00sys-libs.glibc"
@@ -351,7 +391,7 @@ func TestEmptyChannelBehavesLikeLatest(t *testing.T) {
 
 	var result string
 	d.dbptr.View(func(tx *bolt.Tx) error {
-		result = d.lookupPinTx(tx, "sys-libs.glibc")
+		result = d.lookupPinTx(tx, d.channel, "sys-libs.glibc")
 		return nil
 	})
 	if result != "" {
@@ -0,0 +1,289 @@
+package apkgdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	prefetchParallel = 4  // packages downloaded at the same time by a job
+	prefetchKeep     = 16 // finished jobs kept for status queries
+)
+
+// neededSem limits the packages downloaded at the same time to satisfy the
+// libraries needed by other packages
+var neededSem = make(chan struct{}, prefetchParallel)
+
+// PrefetchStatus describes a prefetch job, as returned by v1/prefetch.
+type PrefetchStatus struct {
+	ID       int                `json:"id"`
+	State    string             `json:"state"` // "running", "done" or "failed"
+	Started  time.Time          `json:"started"`
+	Finished *time.Time         `json:"finished,omitempty"`
+	Ready    int                `json:"ready"`    // packages fully downloaded and verified
+	Blocks   int                `json:"blocks"`   // data blocks of all packages
+	Verified int                `json:"verified"` // blocks checked against the hash tables
+	Packages []*PrefetchPackage `json:"packages"`
+}
+
+// PrefetchPackage is the state of a package in a prefetch job.
+type PrefetchPackage struct {
+	*DownloadState
+	Error string `json:"error,omitempty"`
+}
+
+// prefetchJob downloads a set of packages in the background
+type prefetchJob struct {
+	id      int
+	pkgs    []*Package
+	started time.Time
+
+	lk       sync.Mutex
+	finished time.Time
+	errs     []error // by package
+}
+
+// Prefetch resolves names with the channel of the database and fully
+// downloads and verifies the resulting packages in the background, so they
+// can be used without waiting for the network. Names are resolved the same
+// way as a lookup on the filesystem, so a prefix such as core.zlib gives the
+// version selected by the channel. It returns the initial status of the job;
+// its progress can then be followed with PrefetchStatus.
+func (d *DB) Prefetch(names []string) (*PrefetchStatus, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no package to prefetch")
+	}
+
+	var pkgs []*Package
+	seen := make(map[*Package]bool)
+	for _, name := range names {
+		n, err := d.internalLookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		p, ok := d.pkgByIno(n).(*Package)
+		if !ok {
+			// unsigned packages are local files already
+			continue
+		}
+		if !seen[p] {
+			seen[p] = true
+			pkgs = append(pkgs, p)
+		}
+	}
+
+	j := &prefetchJob{pkgs: pkgs, started: time.Now(), errs: make([]error, len(pkgs))}
+
+	d.prefetchLk.Lock()
+	d.prefetchID += 1
+	j.id = d.prefetchID
+	d.prefetchJobs = append(d.prefetchJobs, j)
+	d.prunePrefetch()
+	d.prefetchLk.Unlock()
+
+	go j.run()
+	return j.status(), nil
+}
+
+// PrefetchStatus returns the status of a prefetch job started by Prefetch.
+func (d *DB) PrefetchStatus(id int) (*PrefetchStatus, error) {
+	d.prefetchLk.Lock()
+	defer d.prefetchLk.Unlock()
+
+	for _, j := range d.prefetchJobs {
+		if j.id == id {
+			return j.status(), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// PrefetchJobs returns the status of the recent prefetch jobs, oldest first.
+func (d *DB) PrefetchJobs() []*PrefetchStatus {
+	d.prefetchLk.Lock()
+	defer d.prefetchLk.Unlock()
+
+	res := make([]*PrefetchStatus, 0, len(d.prefetchJobs))
+	for _, j := range d.prefetchJobs {
+		res = append(res, j.status())
+	}
+	return res
+}
+
+// prunePrefetch forgets the oldest finished jobs. prefetchLk must be held.
+func (d *DB) prunePrefetch() {
+	n := len(d.prefetchJobs) - prefetchKeep
+	jobs := d.prefetchJobs[:0]
+	for _, j := range d.prefetchJobs {
+		if n > 0 && j.done() {
+			n -= 1
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	clear(d.prefetchJobs[len(jobs):])
+	d.prefetchJobs = jobs
+}
+
+func (j *prefetchJob) run() {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, prefetchParallel)
+
+	for i, p := range j.pkgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			err := p.prefetch()
+
+			j.lk.Lock()
+			j.errs[i] = err
+			j.lk.Unlock()
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	j.lk.Lock()
+	j.finished = time.Now()
+	j.lk.Unlock()
+}
+
+func (j *prefetchJob) done() bool {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+	return !j.finished.IsZero()
+}
+
+func (j *prefetchJob) status() *PrefetchStatus {
+	res := &PrefetchStatus{ID: j.id, State: "running", Started: j.started, Packages: []*PrefetchPackage{}}
+
+	j.lk.Lock()
+	errs := append([]error{}, j.errs...)
+	if !j.finished.IsZero() {
+		finished := j.finished
+		res.Finished = &finished
+		res.State = "done"
+	}
+	j.lk.Unlock()
+
+	for i, p := range j.pkgs {
+		st := &PrefetchPackage{DownloadState: p.downloadState()}
+		if errs[i] != nil {
+			st.Error = errs[i].Error()
+			if res.Finished != nil {
+				res.State = "failed"
+			}
+		} else if st.State == "ready" && st.Blocks > 0 && st.Verified == st.Blocks {
+			res.Ready += 1
+		}
+		res.Blocks += st.Blocks
+		res.Verified += st.Verified
+		res.Packages = append(res.Packages, st)
+	}
+	return res
+}
+
+// prefetch downloads the whole package and checks all of its data against
+// the hash table.
+func (p *Package) prefetch() error {
+	p.atime.Store(time.Now().UnixNano())
+	p.ensureDl()
+
+	p.dlMu.Lock()
+	ok := p.dlDone
+	p.dlMu.Unlock()
+	if !ok {
+		return fmt.Errorf("failed to download package %s", p.name)
+	}
+
+	// repairing a block of a file that was complete resets the checks of
+	// the other blocks, see invalidateRange
+	for range 2 {
+		if err := p.verifyBlocks(0, int64(p.size)-p.offset); err != nil {
+			return err
+		}
+		if st := p.downloadState(); st.Verified >= st.Blocks {
+			break
+		}
+	}
+	return nil
+}
+
+// SetPrefetchNeeded enables downloading in the background the packages
+// providing the shared libraries a package needs, as listed in the "needed"
+// part of its metadata, when it is first loaded. This applies to the
+// database and its sub databases.
+func (d *DB) SetPrefetchNeeded(v bool) {
+	d.prefetchNeeded.Store(v)
+	d.subLk.RLock()
+	for _, sub := range d.sub {
+		sub.SetPrefetchNeeded(v)
+	}
+	d.subLk.RUnlock()
+}
+
+// prefetchNeededLibs downloads the packages providing the libraries needed
+// by p, found through ld.so.cache. Loading them prefetches the libraries they
+// need in turn.
+func (d *DB) prefetchNeededLibs(p *Package) {
+	var meta struct {
+		Needed []string `json:"needed"`
+	}
+	if err := json.Unmarshal(p.rawMeta, &meta); err != nil || len(meta.Needed) == 0 {
+		return
+	}
+
+	libs := d.ldsoEntries()
+	seen := map[string]bool{p.name: true}
+	var names []string
+	for _, soname := range meta.Needed {
+		e, ok := libs[soname]
+		if !ok {
+			continue
+		}
+		if name := ldsoPackage(e.Value); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		n, err := d.internalLookup(name)
+		if err != nil {
+			continue
+		}
+		dep, ok := d.pkgByIno(n).(*Package)
+		if !ok {
+			continue
+		}
+
+		neededSem <- struct{}{}
+		err = dep.prefetch()
+		<-neededSem
+		if err != nil {
+			log.Printf("apkgdb: %s: failed to prefetch needed package %s: %s", p.name, dep.name, err)
+		}
+	}
+}
+
+// ldsoPackage returns the name of the package of a library path found in
+// ld.so.cache, such as /pkg/main/sys-libs.zlib.libs.1.3.linux.amd64/lib64/libz.so.1
+func ldsoPackage(fn string) string {
+	rest, ok := strings.CutPrefix(fn, "/pkg/")
+	if !ok {
+		return ""
+	}
+	_, rest, _ = strings.Cut(rest, "/") // database name
+	name, _, ok := strings.Cut(rest, "/")
+	if !ok {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,169 @@
+package apkgdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/ldcache"
+)
+
+func TestPrefetchJob(t *testing.T) {
+	good := make([]byte, 3*4096+100)
+	for i := range good {
+		good[i] = byte(i * 3)
+	}
+	bad := bytes.Clone(good)
+	bad[2*4096+10] ^= 0xff
+
+	p := newTestBlockPackage(t, bad, good)
+	p.dlDone = true // already validated
+
+	j := &prefetchJob{id: 1, pkgs: []*Package{p}, started: time.Now(), errs: make([]error, 1)}
+	if st := j.status(); st.State != "running" || st.Verified != 0 || st.Blocks != 4 {
+		t.Fatalf("unexpected initial status: %+v", st)
+	}
+	j.run()
+
+	st := j.status()
+	if st.State != "done" || st.Finished == nil {
+		t.Fatalf("expected job to be done, got %s (%+v)", st.State, st.Packages[0])
+	}
+	if st.Ready != 1 || st.Verified != st.Blocks {
+		t.Errorf("expected all blocks verified, got %d/%d (ready %d)", st.Verified, st.Blocks, st.Ready)
+	}
+
+	// corrupted block should have been fetched again
+	local, err := os.ReadFile(p.lpath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local, good) {
+		t.Error("local copy was not repaired")
+	}
+}
+
+func TestPrefetchJobFailure(t *testing.T) {
+	good := make([]byte, 2*4096)
+	p := newTestBlockPackage(t, good, good)
+	p.dlDone = false
+	p.parent.mirrors = parseMirrors("") // ensureDl cannot download
+
+	j := &prefetchJob{id: 1, pkgs: []*Package{p}, started: time.Now(), errs: make([]error, 1)}
+	j.run()
+
+	st := j.status()
+	if st.State != "failed" || st.Packages[0].Error == "" {
+		t.Errorf("expected failed job with package error, got %s %+v", st.State, st.Packages[0])
+	}
+}
+
+func TestAPIPrefetch(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.mirrors = parseMirrors("")
+
+	send := func(remote, ctype, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/apkgdb/test/v1/prefetch", strings.NewReader(body))
+		r.RemoteAddr = remote
+		r.Header.Set("Content-Type", ctype)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, r)
+		return w
+	}
+	post := func(names ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&APIPrefetchRequest{Names: names})
+		return send("127.0.0.1:4321", "application/json", string(body))
+	}
+
+	if w := post(); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without names, got %d", w.Code)
+	}
+	if w := post("core.missing"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown package, got %d", w.Code)
+	}
+
+	// a web page can send forms to the control interface
+	form := url.Values{"names": {"core.missing"}}.Encode()
+	if w := send("127.0.0.1:4321", "application/x-www-form-urlencoded", form); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a form post, got %d", w.Code)
+	}
+	if w := send("192.0.2.1:4321", "application/json", `{"names":["core.missing"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 from a remote host, got %d", w.Code)
+	}
+
+	var jobs []*PrefetchStatus
+	apiGet(t, d, "/apkgdb/test/v1/prefetch", http.StatusOK, &jobs)
+	if len(jobs) != 0 {
+		t.Errorf("expected no jobs, got %d", len(jobs))
+	}
+
+	var e map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/prefetch?id=1", http.StatusNotFound, &e)
+}
+
+func TestPrunePrefetch(t *testing.T) {
+	d := &DB{}
+	for i := 1; i <= prefetchKeep+3; i++ {
+		j := &prefetchJob{id: i}
+		if i != 2 {
+			j.finished = time.Now()
+		}
+		d.prefetchJobs = append(d.prefetchJobs, j)
+	}
+	d.prunePrefetch()
+
+	if len(d.prefetchJobs) != prefetchKeep {
+		t.Fatalf("expected %d jobs, got %d", prefetchKeep, len(d.prefetchJobs))
+	}
+	// running job 2 is kept, 1, 3 and 4 are dropped
+	if d.prefetchJobs[0].id != 2 || d.prefetchJobs[1].id != 5 {
+		t.Errorf("unexpected jobs kept: %d, %d", d.prefetchJobs[0].id, d.prefetchJobs[1].id)
+	}
+}
+
+func TestLdsoPackage(t *testing.T) {
+	tests := map[string]string{
+		"/pkg/main/sys-libs.zlib.libs.1.3.linux.amd64/lib64/libz.so.1": "sys-libs.zlib.libs.1.3.linux.amd64",
+		"/pkg/corp/corp.foo.libs.1.0.linux.amd64/lib/libfoo.so":        "corp.foo.libs.1.0.linux.amd64",
+		"/usr/lib/libz.so.1": "",
+		"/pkg/main/libz.so":  "",
+	}
+	for in, want := range tests {
+		if got := ldsoPackage(in); got != want {
+			t.Errorf("ldsoPackage(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestPrefetchNeededLibs(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.mirrors = parseMirrors("")
+
+	addTestPackages(t, d, `{}`, "sys-libs.needed.libs.1.0.linux.amd64")
+	d.ldsoEnt = map[string]*ldcache.Entry{
+		"libneeded.so.1": {Key: "libneeded.so.1", Value: "/pkg/main/sys-libs.needed.libs.1.0.linux.amd64/lib64/libneeded.so.1"},
+	}
+
+	p := &Package{parent: d, name: "core.app.core.1.0.linux.amd64", rawMeta: []byte(`{"needed":["libneeded.so.1","libunknown.so.2"]}`)}
+	d.prefetchNeededLibs(p)
+
+	// the package providing libneeded was loaded, its download failed since
+	// there are no mirrors
+	var found bool
+	for _, st := range d.Downloads() {
+		if st.Name == "sys-libs.needed.libs.1.0.linux.amd64" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("package providing a needed library was not loaded")
+	}
+}
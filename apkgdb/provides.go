@@ -0,0 +1,123 @@
+package apkgdb
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ProvidesEntry is a file provided by a package, as recorded in the
+// "provides" part of its metadata.
+type ProvidesEntry struct {
+	Path    string `json:"path"`    // bin/python3
+	Package string `json:"package"` // dev-lang.python.core
+	Name    string `json:"name"`    // full package name, including version
+}
+
+// providesKey builds the BoltDB key for a provided file: "path\x00name".
+func providesKey(path, name string) []byte {
+	k := make([]byte, len(path)+1+len(name))
+	copy(k, path)
+	k[len(path)] = 0x00
+	copy(k[len(path)+1:], name)
+	return k
+}
+
+// addProvidesTx records the files provided by a package.
+func addProvidesTx(b *bolt.Bucket, name []byte, meta *PackageMeta) error {
+	if meta == nil {
+		return nil
+	}
+	for p := range meta.Provides {
+		if p == "" || strings.IndexByte(p, 0) != -1 {
+			continue
+		}
+		if err := b.Put(providesKey(p, string(name)), []byte(meta.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Provides returns the packages providing the given path, such as
+// "bin/python3" or "pkgconfig/zlib.pc". If prefix is true, all paths
+// starting with path are returned. Results are sorted by path, then by
+// package name in natural order so that the latest version comes last. A
+// limit of zero returns all results.
+func (d *DB) Provides(path string, prefix bool, limit int) ([]*ProvidesEntry, error) {
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr == nil {
+		return nil, ErrDatabaseClosed
+	}
+
+	res := []*ProvidesEntry{}
+	err := d.dbptr.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("provides"))
+		p2pB := tx.Bucket([]byte("p2p"))
+		if b == nil || p2pB == nil {
+			return nil
+		}
+
+		seek := []byte(path)
+		if !prefix {
+			seek = append(seek, 0)
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, seek); k, v = c.Next() {
+			p, name, ok := bytes.Cut(k, []byte{0})
+			if !ok {
+				continue
+			}
+			if p2pB.Get(collatedVersion(string(name))) == nil {
+				// package was removed from the database
+				continue
+			}
+			res = append(res, &ProvidesEntry{Path: string(p), Package: string(v), Name: string(name)})
+		}
+		return nil
+	})
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Path != res[j].Path {
+			return res[i].Path < res[j].Path
+		}
+		return natsortCompare(res[i].Name, res[j].Name)
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, err
+}
+
+// pruneProvidesTx removes the entries of the packages no longer in the
+// database.
+func pruneProvidesTx(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte("provides"))
+	p2pB := tx.Bucket([]byte("p2p"))
+	if b == nil || p2pB == nil {
+		return nil
+	}
+
+	var stale [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		_, name, ok := bytes.Cut(k, []byte{0})
+		if !ok || p2pB.Get(collatedVersion(string(name))) == nil {
+			stale = append(stale, bytesDup(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
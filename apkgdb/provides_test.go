@@ -0,0 +1,94 @@
+package apkgdb
+
+import (
+	"net/http"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestProvides(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	meta := `{"name":"dev-lang.python.core","provides":{"bin/python3":{"mode":493},"bin/pydoc3":{"symlink":"pydoc3.12"}}}`
+	addTestPackages(t, d, meta,
+		"dev-lang.python.core.3.12.1.linux.amd64",
+		"dev-lang.python.core.3.9.0.linux.amd64",
+	)
+
+	// database indexed before provides existed
+	err := d.dbptr.Update(func(tx *bolt.Tx) error {
+		_, err := metaIndexTx(tx, "provides", addProvidesTx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Provides("bin/python3", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	if res[1].Name != "dev-lang.python.core.3.12.1.linux.amd64" || res[1].Package != "dev-lang.python.core" {
+		t.Errorf("unexpected result %+v", res[1])
+	}
+
+	// exact match does not return other files
+	if res, _ := d.Provides("bin/python", false, 0); len(res) != 0 {
+		t.Errorf("expected no results for bin/python, got %d", len(res))
+	}
+
+	res, _ = d.Provides("bin/py", true, 0)
+	if len(res) != 4 || res[0].Path != "bin/pydoc3" || res[3].Path != "bin/python3" {
+		t.Errorf("unexpected prefix results %+v", res)
+	}
+	if res, _ := d.Provides("bin/py", true, 1); len(res) != 1 {
+		t.Errorf("limit not applied, got %d results", len(res))
+	}
+	// the limit applies after sorting, 3.12.1 comes first in bbolt order
+	if res, _ := d.Provides("bin/python3", false, 1); len(res) != 1 || res[0].Name != "dev-lang.python.core.3.9.0.linux.amd64" {
+		t.Errorf("unexpected limited results %+v", res)
+	}
+
+	// removed packages are not returned
+	if err := d.RemovePackage("dev-lang.python.core.3.9.0.linux.amd64"); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := d.Provides("bin/python3", false, 0); len(res) != 1 {
+		t.Errorf("expected removed package to be skipped, got %d results", len(res))
+	}
+
+	// and their entries are pruned when indexing
+	var entries int
+	if err := d.writeStart(); err != nil {
+		t.Fatal(err)
+	}
+	err = d.dbptr.Update(func(tx *bolt.Tx) error {
+		if err := pruneProvidesTx(tx); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("provides")).ForEach(func(k, v []byte) error {
+			entries += 1
+			return nil
+		})
+	})
+	d.writeEnd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != 2 {
+		t.Errorf("expected 2 entries left after pruning, got %d", entries)
+	}
+
+	var apiRes []*ProvidesEntry
+	apiGet(t, d, "/apkgdb/test/v1/provides?path=bin/pydoc3", http.StatusOK, &apiRes)
+	if len(apiRes) != 1 || apiRes[0].Package != "dev-lang.python.core" {
+		t.Errorf("unexpected API result %+v", apiRes)
+	}
+	var apiErr map[string]string
+	apiGet(t, d, "/apkgdb/test/v1/provides", http.StatusBadRequest, &apiErr)
+}
@@ -0,0 +1,103 @@
+package apkgdb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Publisher stores exported database files where mirrors serve them from.
+type Publisher interface {
+	Publish(f *PublishFile) error
+}
+
+// PublishFile is a file to publish.
+type PublishFile struct {
+	Key          string // path relative to the mirror root, for example db/main/linux/amd64/LATEST.jwt
+	Path         string // local file
+	CacheControl string
+	ContentType  string
+}
+
+// ParsePublisher returns the publisher described by spec:
+//
+//	""                       no publisher, only export
+//	dry-run                  log what would be published
+//	/srv/www or file:///srv  local directory tree, laid out like the mirrors
+//	s3://bucket/prefix       S3 compatible storage, see NewS3Publisher
+func ParsePublisher(spec string) (Publisher, error) {
+	switch {
+	case spec == "" || spec == "none":
+		return nil, nil
+	case spec == "dry-run":
+		return DryRunPublisher{}, nil
+	case strings.HasPrefix(spec, "s3://"):
+		return NewS3Publisher(spec)
+	case strings.HasPrefix(spec, "file://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &LocalPublisher{Root: u.Path}, nil
+	case strings.Contains(spec, "://"):
+		return nil, fmt.Errorf("unsupported publisher %s", spec)
+	}
+	return &LocalPublisher{Root: spec}, nil
+}
+
+// LocalPublisher copies files to a local directory, which can then be served
+// over HTTP as a mirror.
+type LocalPublisher struct {
+	Root string
+}
+
+func (l *LocalPublisher) Publish(f *PublishFile) error {
+	key := path.Clean("/" + f.Key)
+	target := filepath.Join(l.Root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// write to a temporary file first so mirrors never serve partial files
+	out, err := os.CreateTemp(filepath.Dir(target), ".publish-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), target)
+}
+
+// DryRunPublisher only logs the files that would be published.
+type DryRunPublisher struct{}
+
+func (DryRunPublisher) Publish(f *PublishFile) error {
+	st, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	log.Printf("apkgdb: dry-run: would publish %s (%s, %s, cache-control %s)", f.Key, formatSize(uint64(st.Size())), f.ContentType, f.CacheControl)
+	return nil
+}
@@ -0,0 +1,132 @@
+package apkgdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AzusaOS/apkg/apkgsig"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParsePublisher(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", "")
+
+	if p, err := ParsePublisher(""); p != nil || err != nil {
+		t.Errorf("expected no publisher, got %v %v", p, err)
+	}
+	if p, _ := ParsePublisher("dry-run"); p != (DryRunPublisher{}) {
+		t.Errorf("expected dry-run publisher, got %v", p)
+	}
+	if p, _ := ParsePublisher("file:///srv/apkg"); p.(*LocalPublisher).Root != "/srv/apkg" {
+		t.Errorf("unexpected local publisher %+v", p)
+	}
+	p, err := ParsePublisher("s3://azusa/mirror?endpoint=http://minio:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(*S3Publisher); s.Bucket != "azusa" || s.Prefix != "mirror" || s.Endpoint != "http://minio:9000" || s.Region != "us-east-1" {
+		t.Errorf("unexpected s3 publisher %+v", s)
+	}
+	if _, err := ParsePublisher("ftp://example.com/"); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+}
+
+func TestS3Publish(t *testing.T) {
+	var gotPath, gotAuth, gotHash, gotCache string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		gotPath = r.URL.EscapedPath()
+		gotAuth = r.Header.Get("Authorization")
+		gotHash = r.Header.Get("X-Amz-Content-Sha256")
+		gotCache = r.Header.Get("Cache-Control")
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	fn := filepath.Join(t.TempDir(), "LATEST.txt")
+	os.WriteFile(fn, []byte("20250301000000\n"), 0644)
+
+	s := &S3Publisher{Endpoint: srv.URL, Region: "auto", Bucket: "azusa", Prefix: "pub", AccessKey: "id", SecretKey: "secret", Client: srv.Client()}
+	err := s.Publish(&PublishFile{Key: "db/main/linux/amd64/LATEST.txt", Path: fn, CacheControl: "max-age=60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sha256.Sum256([]byte("20250301000000\n"))
+	if gotPath != "/azusa/pub/db/main/linux/amd64/LATEST.txt" || string(gotBody) != "20250301000000\n" || gotCache != "max-age=60" {
+		t.Errorf("unexpected upload %s %q %q", gotPath, gotBody, gotCache)
+	}
+	if gotHash != hex.EncodeToString(h[:]) {
+		t.Errorf("unexpected payload hash %s", gotHash)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=id/") || !strings.Contains(gotAuth, "/auto/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("unexpected authorization %s", gotAuth)
+	}
+
+	if v := s3Escape("db/a b+c.bin"); v != "db/a%20b%2Bc.bin" {
+		t.Errorf("unexpected escape %s", v)
+	}
+}
+
+func TestExportPublish(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.41.linux.amd64")
+
+	// trust a throwaway key for this database
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustDir := t.TempDir()
+	os.WriteFile(filepath.Join(trustDir, "test.json"), []byte(`{"key":"`+base64.RawURLEncoding.EncodeToString(pub)+`","scope":"db","prefix":"test"}`), 0644)
+	if err := apkgsig.LoadTrustDir(trustDir); err != nil {
+		t.Fatal(err)
+	}
+	defer apkgsig.LoadTrustDir(t.TempDir())
+
+	root := t.TempDir()
+	if err := d.Export(&LocalPublisher{Root: root}, apkgsig.NewKey(priv, "test")); err != nil {
+		t.Fatal(err)
+	}
+
+	dbpath := filepath.Join(root, "db", "test", "linux", "amd64")
+	latest, err := os.ReadFile(filepath.Join(dbpath, "LATEST.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := strings.TrimSpace(string(latest))
+	if _, err := os.Stat(filepath.Join(dbpath, version+".bin")); err != nil {
+		t.Errorf("database file not published: %s", err)
+	}
+
+	token, err := os.ReadFile(filepath.Join(dbpath, "LATEST.jwt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.verifyLatest([]byte(strings.TrimSpace(string(token)))); err != nil || v != version {
+		t.Errorf("published LATEST.jwt failed verification: %q %v", v, err)
+	}
+
+	// a database limited to other signers refuses it
+	d.SetSigners([]string{"other"})
+	if _, err := d.verifyLatest([]byte(strings.TrimSpace(string(token)))); err == nil {
+		t.Error("LATEST.jwt from a key outside the signers accepted")
+	}
+}
@@ -0,0 +1,206 @@
+package apkgdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/petar/GoLLRB/llrb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// releaseGrace is how long a package stays loaded after it was last returned
+// by a lookup, so the kernel has time to reference the inodes it was given.
+const releaseGrace = time.Minute
+
+// releaseStale unloads the packages replaced or removed by an update, as well
+// as the replaced .virtual views, when the kernel does not reference any of
+// their inodes. Their inode ranges are retired: a later lookup of a released
+// package loads it again with a new range. Packages still in use are
+// released after a later update.
+func (d *DB) releaseStale() {
+	root := d
+	if d.parent != nil {
+		root = d.parent
+	}
+
+	var pkgs []*Package
+	var views []*virtualView
+	root.inoLk.RLock()
+	root.ino.AscendGreaterOrEqual(pkgindex(0), func(i llrb.Item) bool {
+		switch v := i.(type) {
+		case *Package:
+			if v.parent == d {
+				pkgs = append(pkgs, v)
+			}
+		case *virtualView:
+			if v.d == d {
+				views = append(views, v)
+			}
+		}
+		return true
+	})
+	root.inoLk.RUnlock()
+
+	d.dbrw.RLock()
+	if d.dbptr == nil {
+		d.dbrw.RUnlock()
+		return
+	}
+	var stale []*Package
+	_ = d.dbptr.View(func(tx *bolt.Tx) error {
+		for _, p := range pkgs {
+			if d.isStaleTx(tx, p) {
+				stale = append(stale, p)
+			}
+		}
+		return nil
+	})
+	d.dbrw.RUnlock()
+
+	// checking the inodes in use scans the kernel's inode cache, so do it
+	// before taking the write lock, see unload
+	candidates := stale[:0]
+	for _, p := range stale {
+		if !p.inUse() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	// no lookup can hand out inodes while we hold the write lock
+	d.dbrw.Lock()
+	defer d.dbrw.Unlock()
+
+	if d.dbptr == nil {
+		return
+	}
+
+	released := 0
+	for _, p := range candidates {
+		if p.release() {
+			released += 1
+		}
+	}
+
+	d.virtLk.Lock()
+	for _, v := range views {
+		if v == d.virtual || v.retired.IsZero() || time.Since(v.retired) < releaseGrace {
+			continue
+		}
+		if d.inodesInUse(v.startIno, v.startIno+v.inodes-1) {
+			continue
+		}
+		d.inoDelete(v)
+		released += 1
+	}
+	d.virtLk.Unlock()
+
+	if released > 0 {
+		log.Printf("apkgdb: released %d stale packages and views of %s", released, d.name)
+	}
+}
+
+// isStaleTx returns true if p was removed from the database, or if its name
+// does not resolve to it anymore on the channels in use.
+func (d *DB) isStaleTx(tx *bolt.Tx, p *Package) bool {
+	b := tx.Bucket([]byte("p2p"))
+	if b == nil {
+		return true
+	}
+	v := b.Get(collatedVersion(p.name))
+	if len(v) < 32 || !bytes.Equal(v[:32], p.hash) {
+		// removed or replaced by a different build
+		return true
+	}
+
+	var meta struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(p.rawMeta, &meta); err != nil || meta.Name == "" {
+		// cannot tell which name it is the current version of
+		return false
+	}
+
+	channels := []string{d.channel}
+	for _, r := range d.ChannelMap() {
+		channels = append(channels, r.Channel)
+	}
+	for _, ch := range channels {
+		if v, _, err := d.resolveTx(tx, ch, meta.Name); err == nil && bytes.Equal(v[:32], p.hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// release unloads a package found not in use by inUse, closing its file and
+// dropping its inode range. The write lock of the database must be held, so
+// no lookup returns the package meanwhile.
+func (p *Package) release() bool {
+	if !p.dlMu.TryLock() {
+		// download in progress
+		return false
+	}
+	defer p.dlMu.Unlock()
+
+	if !p.unload() {
+		return false
+	}
+
+	key := pkgKey{db: p.parent}
+	copy(key.hash[:], p.hash)
+	hashB := key.hash
+
+	root := p.parent.cacheRoot()
+	root.pkgCacheL.Lock()
+	if root.pkgCache[key] == p {
+		delete(root.pkgCache, key)
+	}
+	if root.pkgPaths[p.lpath()] == p {
+		delete(root.pkgPaths, p.lpath())
+	}
+	root.pkgCacheL.Unlock()
+
+	p.parent.inoDelete(p)
+
+	p.parent.pkgIlk.Lock()
+	if p.parent.pkgI[hashB] == p.startIno {
+		delete(p.parent.pkgI, hashB)
+	}
+	p.parent.pkgIlk.Unlock()
+
+	log.Printf("apkgdb: released package %s", p.name)
+	return true
+}
+
+// inUse returns true if the package was returned by a lookup less than
+// releaseGrace ago, or if the kernel references any of its inodes.
+func (p *Package) inUse() bool {
+	if p.lookedRecently() {
+		return true
+	}
+	return p.parent.inodesInUse(p.startIno, p.startIno+p.inodes)
+}
+
+// lookedRecently returns true if the package was returned by a lookup less
+// than releaseGrace ago.
+func (p *Package) lookedRecently() bool {
+	return time.Since(time.Unix(0, p.looked.Load())) < releaseGrace
+}
+
+// unload closes the package file and drops its filesystem. The caller must
+// have checked inUse before taking the write lock: the kernel only gets new
+// inodes of an unused package through a lookup of the package, which would
+// have updated looked, so the inodes are not scanned again here. dlMu and the
+// write lock of the database must be held.
+func (p *Package) unload() bool {
+	if p.lookedRecently() {
+		return false
+	}
+
+	p.closeFile()
+	p.squash = nil
+	p.dlDone = false
+	return true
+}
@@ -0,0 +1,58 @@
+package apkgdb
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestReleaseStale(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	d.mirrors = parseMirrors("")
+	d.channel = "latest"
+
+	names := []string{
+		"test-rel.zlib.libs.1.0.linux.amd64", // stale, looked up recently
+		"test-rel.zlib.libs.1.1.linux.amd64", // stale, referenced by the kernel
+		"test-rel.zlib.libs.1.2.linux.amd64", // stale, released
+		"test-rel.zlib.libs.1.3.linux.amd64", // current version
+	}
+	addTestPackages(t, d, `{"name":"test-rel.zlib.libs"}`, names...)
+
+	pkgs := make([]*Package, len(names))
+	for i, name := range names {
+		n, err := d.internalLookup(name)
+		if err != nil {
+			t.Fatalf("lookup %s: %s", name, err)
+		}
+		pkgs[i] = d.pkgByIno(n).(*Package)
+		if i > 0 {
+			pkgs[i].looked.Store(time.Now().Add(-2 * releaseGrace).UnixNano())
+		}
+	}
+	d.SetNotifyTarget(testTracker{pkgs[1].startIno + 3: true})
+
+	d.releaseStale()
+
+	for i, p := range pkgs {
+		loaded := d.pkgByIno(p.startIno) == p
+		if want := i != 2; loaded != want {
+			t.Errorf("%s: expected loaded=%v, got %v", p.name, want, loaded)
+		}
+	}
+	hashB := sha256.Sum256([]byte(names[2]))
+	if _, ok := d.pkgI[hashB]; ok {
+		t.Error("inode range of released package was not retired")
+	}
+
+	// a released package can be looked up again, with a new inode range
+	n, err := d.internalLookup(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := d.pkgByIno(n).(*Package)
+	if p == pkgs[2] || p.startIno == pkgs[2].startIno {
+		t.Errorf("released package was reused (ino %d)", p.startIno)
+	}
+}
@@ -0,0 +1,246 @@
+package apkgdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgsig"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Revoked package signing keys are distributed in the signed database as
+// type 0x02 records, each with a cutoff time. Packages signed by a revoked
+// key are only accepted if they were created before the cutoff, so packages
+// published before a key leaked remain usable.
+
+// decodeRevokedKey parses a base64url encoded ed25519 public key.
+func decodeRevokedKey(key string) ([]byte, error) {
+	pub, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key length")
+	}
+	return pub, nil
+}
+
+// Revoke marks a package signing key (base64url encoded, as shown in
+// signatures) as revoked for packages created at or after cutoff.
+func (d *DB) Revoke(key string, cutoff time.Time) error {
+	pub, err := decodeRevokedKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeStart(); err != nil {
+		return err
+	}
+	defer d.writeEnd()
+
+	err = d.dbptr.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("revoked"))
+		if err != nil {
+			return err
+		}
+		return b.Put(pub, binary.BigEndian.AppendUint64(nil, uint64(cutoff.Unix())))
+	})
+	if err == nil {
+		// the write lock is held until we return
+		go d.recheckRevoked()
+	}
+	return err
+}
+
+// DeleteRevocation removes the revocation of a package signing key.
+func (d *DB) DeleteRevocation(key string) error {
+	pub, err := decodeRevokedKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeStart(); err != nil {
+		return err
+	}
+	defer d.writeEnd()
+
+	return d.dbptr.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("revoked"))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(pub)
+	})
+}
+
+// Revocations returns the revoked package signing keys and their cutoff.
+func (d *DB) Revocations() map[string]time.Time {
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	result := make(map[string]time.Time)
+	if d.dbptr == nil {
+		return result
+	}
+
+	_ = d.dbptr.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("revoked"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				result[base64.RawURLEncoding.EncodeToString(k)] = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			}
+			return nil
+		})
+	})
+	return result
+}
+
+// checkRevoked returns an error if key was revoked before created.
+func (d *DB) checkRevoked(key string, created time.Time) error {
+	pub, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return err
+	}
+
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr == nil {
+		return ErrDatabaseClosed
+	}
+
+	return d.dbptr.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("revoked"))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(pub)
+		if len(v) != 8 {
+			return nil
+		}
+		cutoff := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		if !created.Before(cutoff) {
+			return fmt.Errorf("package created on %s signed by key %s, revoked since %s", created.UTC().Format(time.RFC3339), key, cutoff.UTC().Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+// recheckRevoked unloads the loaded packages, and removes the downloaded
+// package files, signed by a key revoked before they were created. It is
+// called when revocations were added or changed, since packages are
+// otherwise only checked when loaded.
+func (d *DB) recheckRevoked() {
+	root := d.cacheRoot()
+
+	var pkgs []*Package
+	root.pkgCacheL.RLock()
+	for _, p := range root.pkgCache {
+		if p.parent == d {
+			pkgs = append(pkgs, p)
+		}
+	}
+	root.pkgCacheL.RUnlock()
+
+	for _, p := range pkgs {
+		p.dlMu.Lock()
+		if p.sigKey != "" {
+			if err := d.checkRevoked(p.sigKey, p.created); err != nil {
+				log.Printf("apkgdb: unloading package %s: %s", p.name, err)
+				d.dbrw.Lock()
+				p.closeFile()
+				p.squash = nil
+				p.dlDone = false
+				p.sigKey = ""
+				d.dbrw.Unlock()
+				removeCached(p.lpath())
+				d.cacheUpdate(p.lpath())
+			}
+		}
+		p.dlMu.Unlock()
+	}
+
+	// other downloaded files are checked against the signature they contain
+	if _, err := root.cacheScan(); err != nil {
+		log.Printf("apkgdb: failed to scan cache: %s", err)
+		return
+	}
+	root.cacheStLk.Lock()
+	files := maps.Clone(root.cacheFiles)
+	root.cacheStLk.Unlock()
+
+	check := make(map[string][]byte) // file → package hash
+	d.dbrw.RLock()
+	if d.dbptr != nil {
+		_ = d.dbptr.View(func(tx *bolt.Tx) error {
+			pathB := tx.Bucket([]byte("path"))
+			if pathB == nil {
+				return nil
+			}
+			return pathB.ForEach(func(k, v []byte) error {
+				fn := filepath.Join(d.path, d.name, filepath.FromSlash(string(v)))
+				if _, ok := files[fn]; ok {
+					check[fn] = bytesDup(k)
+				}
+				return nil
+			})
+		})
+	}
+	d.dbrw.RUnlock()
+
+	for fn, hash := range check {
+		key, created, err := fileSigner(fn, hash)
+		if err != nil {
+			// not downloaded yet, checked when loaded
+			continue
+		}
+		if err := d.checkRevoked(key, created); err != nil && root.cacheRemove(fn) {
+			log.Printf("apkgdb: removed %s from cache: %s", fn, err)
+		}
+	}
+}
+
+// fileSigner returns the key that signed the package file fn, and the
+// package creation time. The header of the file must match hash.
+func fileSigner(fn string, hash []byte) (string, time.Time, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 124)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return "", time.Time{}, err
+	}
+	if h := sha256.Sum256(header); !bytes.Equal(h[:], hash) || string(header[:4]) != "APKG" {
+		return "", time.Time{}, errors.New("header invalid or corrupted")
+	}
+
+	// APKG, version, flags, created, metadata, hash, table, hash, sign offset
+	created := time.Unix(int64(binary.BigEndian.Uint64(header[16:24])), int64(binary.BigEndian.Uint64(header[24:32])))
+	signOffset := int64(binary.BigEndian.Uint32(header[112:116]))
+
+	sig := make([]byte, 128)
+	if _, err := f.ReadAt(sig, signOffset); err != nil {
+		return "", time.Time{}, err
+	}
+	sigV, err := apkgsig.VerifyPkg(header, bytes.NewReader(sig))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return sigV.Key, created, nil
+}
@@ -0,0 +1,126 @@
+package apkgdb
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevokedKey(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	key := "n21_CiuzEuo_OaSfEVodAXpQtcc4Qe_NprMSAs3B9QU"
+	cutoff := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := d.checkRevoked(key, cutoff); err != nil {
+		t.Errorf("key should not be revoked yet: %s", err)
+	}
+
+	if err := d.Revoke("AAAA", cutoff); err == nil {
+		t.Error("invalid key should have been refused")
+	}
+	if err := d.Revoke(key, cutoff); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.checkRevoked(key, cutoff.Add(-time.Hour)); err != nil {
+		t.Errorf("package created before cutoff should be accepted: %s", err)
+	}
+	if err := d.checkRevoked(key, cutoff); err == nil {
+		t.Error("package created at cutoff should be refused")
+	}
+	if err := d.checkRevoked(key, cutoff.Add(time.Hour)); err == nil {
+		t.Error("package created after cutoff should be refused")
+	}
+
+	if r := d.Revocations(); len(r) != 1 || !r[key].Equal(cutoff) {
+		t.Errorf("unexpected revocations %v", r)
+	}
+
+	if err := d.DeleteRevocation(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkRevoked(key, cutoff.Add(time.Hour)); err != nil {
+		t.Errorf("key should not be revoked anymore: %s", err)
+	}
+}
+
+func TestRevocationRemovedOnUpdate(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+	key := newTestExportKey(t)
+	revoked := "n21_CiuzEuo_OaSfEVodAXpQtcc4Qe_NprMSAs3B9QU"
+
+	addTestPackages(t, d, `{}`, "sys-libs.glibc.libs.2.40.linux.amd64")
+	if err := d.Revoke(revoked, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+
+	client, cleanup2 := newTestDB(t)
+	defer cleanup2()
+	if err := indexTestFile(client, filepath.Join(d.path, d.CurrentVersion()+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if r := client.Revocations(); len(r) != 1 {
+		t.Fatalf("expected revocation on client, got %v", r)
+	}
+
+	// versions have a one second resolution
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	if err := d.DeleteRevocation(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Export(nil, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexTestFile(client, filepath.Join(d.path, d.CurrentVersion()+".bin")); err != nil {
+		t.Fatal(err)
+	}
+	if r := client.Revocations(); len(r) != 0 {
+		t.Errorf("removed revocation still present on client: %v", r)
+	}
+}
+
+func TestRecheckRevoked(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	key := "n21_CiuzEuo_OaSfEVodAXpQtcc4Qe_NprMSAs3B9QU"
+	cutoff := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// packages already loaded, signed by the key before and after the cutoff
+	loaded := func(name string, created time.Time) *Package {
+		hash := sha256.Sum256([]byte(name))
+		p := &Package{parent: d, name: name, path: "core/" + name + ".apkg", hash: hash[:], sigKey: key, created: created, dlDone: true}
+		writeCacheFile(t, p.lpath(), 4096, 0)
+		d.pkgCache[pkgKey{d, hash}] = p
+		d.pkgPaths[p.lpath()] = p
+		return p
+	}
+	d.pkgCache = make(map[pkgKey]*Package)
+	d.pkgPaths = make(map[string]*Package)
+	before := loaded("core.before.1.0.linux.amd64", cutoff.Add(-time.Hour))
+	after := loaded("core.after.1.0.linux.amd64", cutoff.Add(time.Hour))
+
+	if err := d.Revoke(key, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	d.recheckRevoked()
+
+	if !before.dlDone {
+		t.Errorf("package created before the cutoff should stay loaded")
+	}
+	if after.dlDone {
+		t.Errorf("package created after the cutoff should have been unloaded")
+	}
+	if _, err := os.Stat(after.lpath()); !os.IsNotExist(err) {
+		t.Errorf("file of revoked package should have been removed")
+	}
+}
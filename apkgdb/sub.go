@@ -32,6 +32,12 @@ func (d *DB) SubGet(sub ArchOS) (*DB, error) {
 	}
 	db.parent = d
 	db.channel = d.channel
+	db.overrides.Store(d.overrides.Load())
+	db.channelMap.Store(d.channelMap.Load())
+	db.maxAgeWarn = d.maxAgeWarn
+	db.maxAgeRefuse = d.maxAgeRefuse
+	db.signers = d.signers
+	db.prefetchNeeded.Store(d.prefetchNeeded.Load())
 
 	d.sub[sub] = db
 	return db, nil
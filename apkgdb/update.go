@@ -22,7 +22,9 @@ func init() {
 }
 
 func (d *DB) download(v string) (bool, error) {
-	resp, err := hClient.Get(d.prefix + "db/" + d.name + "/" + d.os + "/" + d.arch + "/LATEST.jwt")
+	dbpath := "db/" + d.name + "/" + d.os + "/" + d.arch + "/"
+
+	resp, err := d.mirrors.get(dbpath+"LATEST.jwt", nil)
 	if err != nil {
 		return false, err
 	}
@@ -45,36 +47,11 @@ func (d *DB) download(v string) (bool, error) {
 		return false, nil
 	}
 
-	dec, err := jwt.ParseString(string(token))
-	if err != nil {
-		return false, err
-	}
-	kid := dec.GetKeyId()
-	kidName := apkgsig.DbKeyName(kid)
-	if kidName == "" {
-		return false, errors.New("unknown key used for jwt signature")
-	}
-
-	// decode ed25519 key
-	tmpv, err := base64.RawURLEncoding.DecodeString(kid)
-	if err != nil {
-		return false, err
-	}
-	publicKey := ed25519.PublicKey(tmpv)
-
-	err = dec.Verify(jwt.VerifyAlgo(jwt.EdDSA), jwt.VerifySignature(publicKey))
+	version, err := d.verifyLatest(token)
 	if err != nil {
 		return false, err
 	}
 
-	// jwt is valid
-	version := dec.Payload().GetString("ver")
-	if version == "" {
-		return false, errors.New("invalid version in signed jwt")
-	}
-
-	//log.Printf("apkgdb: got database descriptor to version %s signed by %s", version, kidName)
-
 	resp = nil
 
 	if v != "" {
@@ -86,7 +63,7 @@ func (d *DB) download(v string) (bool, error) {
 		// check for delta
 		log.Printf("apkgdb: Downloading %s database delta to version %s ...", d.name, version)
 
-		resp, err = hClient.Get(d.prefix + "db/" + d.name + "/" + d.os + "/" + d.arch + "/" + v + "-" + string(version) + ".bin")
+		resp, err = d.mirrors.get(dbpath+v+"-"+string(version)+".bin", nil)
 		if err != nil {
 			return false, err
 		}
@@ -96,13 +73,18 @@ func (d *DB) download(v string) (bool, error) {
 			log.Printf("apkgdb: Delta download failed with error %s, will download full database", resp.Status)
 			// fallback to downloading the whole db
 			resp = nil
+		} else if err := d.indexFrom(resp.Body); err != nil {
+			log.Printf("apkgdb: Failed to apply delta: %s, will download full database", err)
+			resp = nil
+		} else {
+			return true, nil
 		}
 	}
 
 	if resp == nil {
 		log.Printf("apkgdb: Downloading %s database version %s ...", d.name, version)
 
-		resp, err = hClient.Get(d.prefix + "db/" + d.name + "/" + d.os + "/" + d.arch + "/" + string(version) + ".bin")
+		resp, err = d.mirrors.get(dbpath+string(version)+".bin", nil)
 		if err != nil {
 			return false, err
 		}
@@ -113,34 +95,98 @@ func (d *DB) download(v string) (bool, error) {
 		}
 	}
 
-	out, err := os.CreateTemp("", "apkg")
+	return true, d.indexFrom(resp.Body)
+}
+
+// verifyLatest checks the signature and claims of a LATEST.jwt token, and
+// returns the database version it points to. The token carries a single
+// signature, so the signers threshold only applies to the database file it
+// points to.
+func (d *DB) verifyLatest(token []byte) (string, error) {
+	dec, err := jwt.ParseString(string(token))
 	if err != nil {
-		return false, err
+		return "", err
+	}
+	kid := dec.GetKeyId()
+	kidV := apkgsig.TrustedDbKey(kid)
+	if kidV == nil {
+		return "", errors.New("unknown key used for jwt signature")
+	}
+	if !kidV.Allows(d.name) || !apkgsig.AllowedSigner(kidV.Name, d.signers) {
+		return "", fmt.Errorf("jwt signed by %s, which is not trusted for database %s", kidV.Name, d.name)
 	}
 
-	_, err = io.Copy(out, resp.Body)
+	// decode ed25519 key
+	tmpv, err := base64.RawURLEncoding.DecodeString(kid)
 	if err != nil {
-		out.Close()
-		os.Remove(out.Name())
+		return "", err
+	}
+	publicKey := ed25519.PublicKey(tmpv)
 
-		return false, err
+	err = dec.Verify(jwt.VerifyAlgo(jwt.EdDSA), jwt.VerifySignature(publicKey), jwt.VerifyTime(time.Now(), false))
+	if err != nil {
+		return "", err
 	}
 
-	if _, err = out.Seek(0, io.SeekStart); err != nil {
-		out.Close()
-		os.Remove(out.Name())
-		return false, err
+	// jwt is valid, make sure it is for this database
+	for k, v := range map[string]string{"name": d.name, "os": d.os, "arch": d.arch} {
+		if cv := dec.Payload().GetString(k); cv != "" && cv != v {
+			return "", fmt.Errorf("signed jwt is for %s %s, not %s", k, cv, v)
+		}
 	}
 
-	err = d.index(out)
-	out.Close()
-	os.Remove(out.Name())
+	version := dec.Payload().GetString("ver")
+	if version == "" {
+		return "", errors.New("invalid version in signed jwt")
+	}
 
-	return true, err
+	// make sure we are not being sent back to an older version
+	if err := d.checkVersion(version); err != nil {
+		return "", err
+	}
+
+	// older tokens have no iat, use the database version time instead
+	signed := dec.Payload().GetNumericDate("iat")
+	if signed.IsZero() {
+		signed, _ = time.Parse(versionFormat, version)
+	}
+	if err := d.checkAge(signed); err != nil {
+		return "", err
+	}
+
+	//log.Printf("apkgdb: got database descriptor to version %s signed by %s", version, kidV.Name)
+
+	return version, nil
+}
+
+// indexFrom stores a database file read from r in a temporary file, and
+// indexes it.
+func (d *DB) indexFrom(r io.Reader) error {
+	out, err := os.CreateTemp("", "apkg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if _, err = io.Copy(out, r); err != nil {
+		return err
+	}
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return d.index(out)
 }
 
 func (d *DB) update() error {
+	if d.mirrors.best() == nil {
+		// offline, updates only come from imported bundles
+		d.checkFreshness()
+		return nil
+	}
 	_, err := d.download(d.CurrentVersion())
+	d.checkFreshness()
 	return err
 }
 
@@ -165,6 +211,7 @@ func (d *DB) updateThread(updateReq bool) {
 			if err != nil {
 				log.Printf("apkgdb: update failed: %s", err)
 			}
+			d.cacheCheck()
 		case <-d.upd:
 			err := d.update()
 			if err != nil {
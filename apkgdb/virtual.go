@@ -0,0 +1,314 @@
+package apkgdb
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgfs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/petar/GoLLRB/llrb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Packages can provide symlinks to be shared in virtual views, for example
+// python modules. apkg-convert stores them in the "virtual" part of the
+// metadata as view name → link name → path in the package. The .virtual
+// directory at the root of the filesystem has one directory per view,
+// merging the links of the packages lookups currently resolve to:
+//
+//	.virtual/python-modules-3.12/numpy → ../../dev-python.numpy.mod.1.26.4.linux.amd64/lib/python3.12/site-packages/numpy
+//
+// Inode 3 is the .virtual directory itself. Views and links get inodes
+// allocated when the view is built, and a new set is allocated each time the
+// database or the channel changes.
+
+// virtualKey builds the BoltDB key for a virtual link: "view\x00link\x00name".
+func virtualKey(view, link, name string) []byte {
+	return []byte(view + "\x00" + link + "\x00" + name)
+}
+
+// addVirtualTx records the virtual links provided by a package.
+func addVirtualTx(b *bolt.Bucket, name []byte, meta *PackageMeta) error {
+	if meta == nil || meta.Name == "" {
+		return nil
+	}
+	for view, links := range meta.Virtual {
+		if !validVirtualName(view) {
+			continue
+		}
+		for link, target := range links {
+			if !validVirtualName(link) || !validVirtualTarget(target) {
+				log.Printf("apkgdb: %s: ignoring invalid virtual link %s/%s", name, view, link)
+				continue
+			}
+			if err := b.Put(virtualKey(view, link, string(name)), []byte(meta.Name+"\x00"+target)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validVirtualName(n string) bool {
+	return n != "" && n != "." && n != ".." && len(n) <= 255 && !strings.ContainsAny(n, "/\x00")
+}
+
+func validVirtualTarget(t string) bool {
+	if t == "" || strings.IndexByte(t, 0) != -1 || path.IsAbs(t) {
+		return false
+	}
+	t = path.Clean(t)
+	return t != ".." && !strings.HasPrefix(t, "../")
+}
+
+// virtualView is the content of the .virtual directory at a given time.
+type virtualView struct {
+	d        *DB
+	startIno uint64
+	inodes   uint64
+	views    []*virtualDir // sorted by name
+	retired  time.Time     // when the view was replaced, protected by d.virtLk
+}
+
+type virtualDir struct {
+	ino   uint64
+	name  string
+	links []*virtualLink // sorted by name
+}
+
+type virtualLink struct {
+	ino    uint64
+	name   string
+	target []byte
+}
+
+func (v *virtualView) Value() uint64 {
+	return v.startIno
+}
+
+func (v *virtualView) Less(than llrb.Item) bool {
+	return v.startIno < than.(pkgindexItem).Value()
+}
+
+func (v *virtualView) lookup(name string) *virtualDir {
+	i := sort.Search(len(v.views), func(i int) bool { return v.views[i].name >= name })
+	if i < len(v.views) && v.views[i].name == name {
+		return v.views[i]
+	}
+	return nil
+}
+
+func (v *virtualView) handleLookup(ino uint64) (apkgfs.Inode, error) {
+	for _, dir := range v.views {
+		if dir.ino == ino {
+			return dir, nil
+		}
+		if len(dir.links) == 0 || ino > dir.links[len(dir.links)-1].ino {
+			continue
+		}
+		for _, l := range dir.links {
+			if l.ino == ino {
+				return apkgfs.NewSymlink(l.target), nil
+			}
+		}
+	}
+	return nil, os.ErrInvalid
+}
+
+// getVirtual returns the current virtual view, building it if needed.
+func (d *DB) getVirtual() *virtualView {
+	d.virtLk.Lock()
+	defer d.virtLk.Unlock()
+
+	if d.virtual != nil {
+		return d.virtual
+	}
+
+	v, err := d.buildVirtual()
+	if err != nil {
+		log.Printf("apkgdb: failed to build virtual view: %s", err)
+		return &virtualView{}
+	}
+	d.virtual = v
+	return v
+}
+
+// resetVirtual causes the virtual view to be built again on next access.
+func (d *DB) resetVirtual() {
+	d.virtLk.Lock()
+	defer d.virtLk.Unlock()
+
+	if d.virtual != nil {
+		d.virtual.retired = time.Now()
+	}
+	d.virtual = nil
+}
+
+func (d *DB) buildVirtual() (*virtualView, error) {
+	d.dbrw.RLock()
+	defer d.dbrw.RUnlock()
+
+	if d.dbptr == nil {
+		return nil, ErrDatabaseClosed
+	}
+
+	res := &virtualView{d: d}
+	var cur *virtualDir
+	var count uint64
+
+	err := d.dbptr.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("virtual"))
+		if b == nil {
+			return nil
+		}
+
+		// package name without version → full name it resolves to
+		resolved := make(map[string]string)
+
+		return b.ForEach(func(k, v []byte) error {
+			parts := bytes.SplitN(k, []byte{0}, 3)
+			family, target, ok := bytes.Cut(v, []byte{0})
+			if len(parts) != 3 || !ok {
+				return nil
+			}
+
+			full, ok := resolved[string(family)]
+			if !ok {
+				if pv, _, err := d.resolveTx(tx, d.channel, string(family)); err == nil {
+					full = string(pv[32+8:])
+				}
+				resolved[string(family)] = full
+			}
+			if full != string(parts[2]) {
+				// not the version currently in use
+				return nil
+			}
+
+			view, link := string(parts[0]), string(parts[1])
+			if cur == nil || cur.name != view {
+				cur = &virtualDir{name: view}
+				res.views = append(res.views, cur)
+				count += 1
+			}
+			if n := len(cur.links); n > 0 && cur.links[n-1].name == link {
+				// provided by more than one package, keep the first one
+				return nil
+			}
+			cur.links = append(cur.links, &virtualLink{name: link, target: []byte("../../" + full + "/" + string(target))})
+			count += 1
+			return nil
+		})
+	})
+	if err != nil || count == 0 {
+		return res, err
+	}
+
+	res.startIno = d.allocInodes(count)
+	res.inodes = count
+	ino := res.startIno
+	for _, dir := range res.views {
+		dir.ino = ino
+		ino += 1
+		for _, l := range dir.links {
+			l.ino = ino
+			ino += 1
+		}
+	}
+
+	d.inoInsert(res)
+
+	log.Printf("apkgdb: built virtual view with %d directories", len(res.views))
+	return res, nil
+}
+
+// virtualRoot is the .virtual directory. It always shows the current view,
+// as the kernel may keep the inode for a long time.
+type virtualRoot struct {
+	d *DB
+}
+
+func (r virtualRoot) Mode() os.FileMode {
+	return os.ModeDir | 0555
+}
+
+func (r virtualRoot) Lookup(ctx context.Context, name string) (uint64, error) {
+	if dir := r.d.getVirtual().lookup(name); dir != nil {
+		return dir.ino, nil
+	}
+	return 0, os.ErrNotExist
+}
+
+func (r virtualRoot) Readlink() ([]byte, error) {
+	return nil, os.ErrInvalid
+}
+
+func (r virtualRoot) Open(flags uint32) (uint32, error) {
+	return 0, os.ErrInvalid
+}
+
+func (r virtualRoot) OpenDir() (uint32, error) {
+	return 0, nil
+}
+
+func (r virtualRoot) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) error {
+	views := r.d.getVirtual().views
+	entries := make([]dirEntry, 0, len(views))
+	for _, dir := range views {
+		entries = append(entries, dirEntry{name: dir.name, ino: dir.ino, inode: dir})
+	}
+	return fillDir(input, out, plus, 3, 1, r, entries)
+}
+
+func (r virtualRoot) AddRef(count uint64) uint64 {
+	return 1
+}
+
+func (r virtualRoot) DelRef(count uint64) uint64 {
+	return 0
+}
+
+func (dir *virtualDir) Mode() os.FileMode {
+	return os.ModeDir | 0555
+}
+
+func (dir *virtualDir) Lookup(ctx context.Context, name string) (uint64, error) {
+	i := sort.Search(len(dir.links), func(i int) bool { return dir.links[i].name >= name })
+	if i < len(dir.links) && dir.links[i].name == name {
+		return dir.links[i].ino, nil
+	}
+	return 0, os.ErrNotExist
+}
+
+func (dir *virtualDir) Readlink() ([]byte, error) {
+	return nil, os.ErrInvalid
+}
+
+func (dir *virtualDir) Open(flags uint32) (uint32, error) {
+	return 0, os.ErrInvalid
+}
+
+func (dir *virtualDir) OpenDir() (uint32, error) {
+	return fuse.FOPEN_KEEP_CACHE, nil
+}
+
+func (dir *virtualDir) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList, plus bool) error {
+	entries := make([]dirEntry, 0, len(dir.links))
+	for _, l := range dir.links {
+		entries = append(entries, dirEntry{name: l.name, ino: l.ino, inode: apkgfs.NewSymlink(l.target)})
+	}
+	return fillDir(input, out, plus, dir.ino, 3, dir, entries)
+}
+
+func (dir *virtualDir) AddRef(count uint64) uint64 {
+	return 1
+}
+
+func (dir *virtualDir) DelRef(count uint64) uint64 {
+	return 0
+}
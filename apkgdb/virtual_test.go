@@ -0,0 +1,97 @@
+package apkgdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	bolt "go.etcd.io/bbolt"
+)
+
+// virtualTarget resolves .virtual/<view>/<link> through the DB inodes.
+func virtualTarget(t *testing.T, d *DB, view, link string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	n, err := d.Lookup(ctx, ".virtual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := d.GetInode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = root.Lookup(ctx, view)
+	if err != nil {
+		return ""
+	}
+	dir, err := d.GetInode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = dir.Lookup(ctx, link)
+	if err != nil {
+		return ""
+	}
+	l, err := d.GetInode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := l.Readlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(target)
+}
+
+func TestVirtualView(t *testing.T) {
+	d, cleanup := newTestDB(t)
+	defer cleanup()
+
+	addTestPackages(t, d, `{"name":"dev-python.numpy.mod","virtual":{"python-modules-3.12":{"numpy":"lib/python3.12/site-packages/numpy"}}}`,
+		"dev-python.numpy.mod.1.25.0.linux.amd64",
+		"dev-python.numpy.mod.1.26.4.linux.amd64",
+	)
+	addTestPackages(t, d, `{"name":"dev-python.six.mod","virtual":{"python-modules-3.12":{"six.py":"lib/six.py","evil":"../../../etc"}}}`,
+		"dev-python.six.mod.1.16.0.linux.amd64",
+	)
+	err := d.dbptr.Update(func(tx *bolt.Tx) error {
+		_, err := metaIndexTx(tx, "virtual", addVirtualTx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.channel = "stable"
+	if v := virtualTarget(t, d, "python-modules-3.12", "numpy"); v != "../../dev-python.numpy.mod.1.26.4.linux.amd64/lib/python3.12/site-packages/numpy" {
+		t.Errorf("unexpected numpy link %q", v)
+	}
+	if v := virtualTarget(t, d, "python-modules-3.12", "six.py"); v != "../../dev-python.six.mod.1.16.0.linux.amd64/lib/six.py" {
+		t.Errorf("unexpected six link %q", v)
+	}
+	if v := virtualTarget(t, d, "python-modules-3.12", "evil"); v != "" {
+		t.Errorf("link outside of package should have been ignored, got %q", v)
+	}
+	if v := virtualTarget(t, d, "python-modules-3.11", "numpy"); v != "" {
+		t.Errorf("unexpected link in missing view %q", v)
+	}
+
+	// the view follows pins once rebuilt
+	d.SetPin("stable", "dev-python.numpy.mod", "1.25")
+	d.SetChannel("stable")
+	if v := virtualTarget(t, d, "python-modules-3.12", "numpy"); v != "../../dev-python.numpy.mod.1.25.0.linux.amd64/lib/python3.12/site-packages/numpy" {
+		t.Errorf("unexpected pinned numpy link %q", v)
+	}
+
+	root, _ := d.GetInode(3)
+	buf := make([]byte, 4096)
+	out := fuse.NewDirEntryList(buf, 0)
+	if err := root.ReadDir(&fuse.ReadIn{}, out, false); err != nil {
+		t.Fatal(err)
+	}
+	// ".", ".." and one view
+	if out.Offset != 3 {
+		t.Errorf("expected 3 entries in .virtual, got %d", out.Offset)
+	}
+}
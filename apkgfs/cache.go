@@ -43,3 +43,17 @@ func (p *PkgFS) removeFromCache(nodeid, nlookup uint64) {
 		delete(p.inoCache, nodeid)
 	}
 }
+
+// InodesInUse returns true if any inode between start and end (inclusive)
+// is currently referenced by the kernel.
+func (p *PkgFS) InodesInUse(start, end uint64) bool {
+	p.inoCacheL.RLock()
+	defer p.inoCacheL.RUnlock()
+
+	for ino := range p.inoCache {
+		if ino >= start && ino <= end {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,31 @@
 package apkgfs
 
+import "context"
+
 type Value int
 
 const (
 	Pid Value = iota
 	Uid
 	Gid
+	volatile
 )
+
+// lookupContext returns the context passed to Inode.Lookup for a request
+// from the given caller, and a flag set by SetVolatile.
+func lookupContext(pid, uid, gid uint32) (context.Context, *bool) {
+	v := new(bool)
+	ctx := context.WithValue(context.Background(), Pid, pid)
+	ctx = context.WithValue(ctx, Uid, uid)
+	ctx = context.WithValue(ctx, Gid, gid)
+	ctx = context.WithValue(ctx, volatile, v)
+	return ctx, v
+}
+
+// SetVolatile marks the result of a lookup as depending on the caller, so
+// the kernel does not cache it and asks again for each process.
+func SetVolatile(ctx context.Context) {
+	if v, ok := ctx.Value(volatile).(*bool); ok {
+		*v = true
+	}
+}
@@ -2,7 +2,6 @@
 package apkgfs
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"log"
@@ -140,7 +139,7 @@ func (p *PkgFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name strin
 		return toStatus(err)
 	}
 
-	ctx := context.WithValue(context.Background(), Pid, header.Caller.Pid)
+	ctx, volatile := lookupContext(header.Caller.Pid, header.Caller.Owner.Uid, header.Caller.Owner.Gid)
 
 	sub, err := ino.Lookup(ctx, name)
 	if err != nil {
@@ -161,7 +160,11 @@ func (p *PkgFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name strin
 		return toStatus(err)
 	}
 
-	out.SetEntryTimeout(30 * time.Second)
+	if *volatile {
+		out.SetEntryTimeout(0)
+	} else {
+		out.SetEntryTimeout(30 * time.Second)
+	}
 	out.SetAttrTimeout(30 * time.Second)
 	return fuse.OK
 }
@@ -259,6 +262,11 @@ func (p *PkgFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.Op
 		return fuse.ENOTDIR
 	}
 
+	if dh, ok := ino.(DirHandleInode); ok {
+		out.Fh, out.OpenFlags, err = dh.OpenDirHandle()
+		return toStatus(err)
+	}
+
 	out.OpenFlags, err = ino.OpenDir()
 	return toStatus(err)
 }
@@ -291,7 +299,14 @@ func (p *PkgFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 	return toStatus(err)
 }
 
-//    ReleaseDir(input *ReleaseIn)
+func (p *PkgFS) ReleaseDir(input *fuse.ReleaseIn) {
+	if ino, err := p.getInode(input.NodeId); err == nil {
+		if dh, ok := ino.(DirHandleInode); ok {
+			dh.ReleaseDir(input.Fh)
+		}
+	}
+}
+
 //    FsyncDir(cancel <-chan struct{}, input *FsyncIn) (code Status)
 //
 
@@ -35,6 +35,18 @@ type Inode interface {
 	DelRef(count uint64) uint64
 }
 
+// DirHandleInode is implemented by directories keeping a state per open
+// handle, such as a snapshot of their entries. The handle is passed to
+// ReadDir in input.Fh.
+type DirHandleInode interface {
+	Inode
+
+	// OpenDirHandle opens a directory and returns a handle and FUSE open flags.
+	OpenDirHandle() (uint64, uint32, error)
+	// ReleaseDir releases a handle returned by OpenDirHandle.
+	ReleaseDir(fh uint64)
+}
+
 // RootInode extends Inode with methods required for the filesystem root.
 // It provides inode lookup and filesystem statistics.
 type RootInode interface {
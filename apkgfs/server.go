@@ -1,7 +1,6 @@
 package apkgfs
 
 import (
-	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -154,8 +153,10 @@ func (s *FuseServer) handleRequest(data []byte) {
 		s.doOpen(hdr, body)
 	case opRead:
 		s.doRead(hdr, body)
-	case opRelease, opReleasedir:
+	case opRelease:
 		// no-op, no response needed for release
+	case opReleasedir:
+		s.doReleaseDir(hdr, body)
 	case opStatfs:
 		s.doStatFs(hdr, body)
 	case opOpendir:
@@ -191,7 +192,7 @@ func (s *FuseServer) doLookup(hdr *fuseInHeader, body []byte) {
 		return
 	}
 
-	ctx := context.WithValue(context.Background(), Pid, hdr.Pid)
+	ctx, volatile := lookupContext(hdr.Pid, hdr.Uid, hdr.Gid)
 	sub, err := ino.Lookup(ctx, name)
 	if err != nil {
 		s.replyErr(hdr.Unique, err)
@@ -215,7 +216,11 @@ func (s *FuseServer) doLookup(hdr *fuseInHeader, body []byte) {
 		s.replyErr(hdr.Unique, err)
 		return
 	}
-	out.SetEntryTimeout(30 * time.Second)
+	if *volatile {
+		out.SetEntryTimeout(0)
+	} else {
+		out.SetEntryTimeout(30 * time.Second)
+	}
 	out.SetAttrTimeout(30 * time.Second)
 
 	s.reply(hdr.Unique, 0, entryOutBytes(&out))
@@ -365,23 +370,43 @@ func (s *FuseServer) doOpenDir(hdr *fuseInHeader, body []byte) {
 		return
 	}
 
-	openFlags, err := ino.OpenDir()
+	var out fuse.OpenOut
+	if dh, ok := ino.(DirHandleInode); ok {
+		out.Fh, out.OpenFlags, err = dh.OpenDirHandle()
+	} else {
+		out.OpenFlags, err = ino.OpenDir()
+	}
 	if err != nil {
 		s.replyErr(hdr.Unique, err)
 		return
 	}
 
-	var out fuse.OpenOut
-	out.OpenFlags = openFlags
 	s.reply(hdr.Unique, 0, openOutBytes(&out))
 }
 
+func (s *FuseServer) doReleaseDir(hdr *fuseInHeader, body []byte) {
+	if len(body) < 8 {
+		return
+	}
+	// ReleaseIn after InHeader: Fh(8) + Flags(4) + ReleaseFlags(4) + LockOwner(8)
+	fh := binary.LittleEndian.Uint64(body[0:8])
+
+	ino, err := s.fs.getInode(hdr.NodeId)
+	if err != nil {
+		return
+	}
+	if dh, ok := ino.(DirHandleInode); ok {
+		dh.ReleaseDir(fh)
+	}
+}
+
 func (s *FuseServer) doReadDir(hdr *fuseInHeader, body []byte, plus bool) {
 	if len(body) < 24 {
 		s.replyStatus(hdr.Unique, int32(syscall.EINVAL))
 		return
 	}
 	// ReadIn after InHeader: Fh(8) + Offset(8) + Size(4)
+	fh := binary.LittleEndian.Uint64(body[0:8])
 	offset := binary.LittleEndian.Uint64(body[8:16])
 	size := binary.LittleEndian.Uint32(body[16:20])
 
@@ -399,6 +424,7 @@ func (s *FuseServer) doReadDir(hdr *fuseInHeader, body []byte, plus bool) {
 	// Build a fuse.ReadIn to pass to the Inode.ReadDir interface
 	var readIn fuse.ReadIn
 	readIn.NodeId = hdr.NodeId
+	readIn.Fh = fh
 	readIn.Offset = offset
 	readIn.Size = size
 
@@ -21,3 +21,7 @@ func (res *PkgFS) doMount() error {
 func (s *FuseServer) GracefulExec(newBinary string) error {
 	return errors.New("graceful exec not supported on darwin")
 }
+
+func GracefulExec(newBinary string, servers ...*FuseServer) error {
+	return errors.New("graceful exec not supported on darwin")
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 )
 
@@ -50,58 +51,90 @@ func fuseUnmount(mountPoint string) error {
 	return syscall.Unmount(mountPoint, 0)
 }
 
-// inheritedFd checks if a FUSE fd was inherited from a parent process
-// (graceful restart). Returns the fd and mount point, or -1 if not inherited.
-func inheritedFd() (fd int, mountPoint string) {
-	fdStr := os.Getenv("APKG_FUSE_FD")
-	mountPoint = os.Getenv("APKG_MOUNT_POINT")
-	if fdStr == "" || mountPoint == "" {
-		return -1, ""
-	}
+var (
+	inheritOnce sync.Once
+	inheritLk   sync.Mutex
+	inherited   map[string]int // mount point → fd, not yet claimed
+)
 
-	n, err := strconv.Atoi(fdStr)
-	if err != nil {
-		return -1, ""
-	}
+// inheritedFd checks if a FUSE fd for mountPoint was inherited from a parent
+// process (graceful restart). APKG_FUSE_FD and APKG_MOUNT_POINT hold lists of
+// fds and mount points, separated like $PATH. Returns the fd and actual mount
+// point, or -1 if not inherited.
+func inheritedFd(mountPoints ...string) (fd int, mountPoint string) {
+	inheritOnce.Do(func() {
+		fds := filepath.SplitList(os.Getenv("APKG_FUSE_FD"))
+		mps := filepath.SplitList(os.Getenv("APKG_MOUNT_POINT"))
+
+		// Clear the env vars so children don't inherit them accidentally
+		os.Unsetenv("APKG_FUSE_FD")
+		os.Unsetenv("APKG_MOUNT_POINT")
+
+		inherited = make(map[string]int)
+		for i := 0; i < len(fds) && i < len(mps); i++ {
+			if n, err := strconv.Atoi(fds[i]); err == nil {
+				inherited[mps[i]] = n
+			}
+		}
+	})
 
-	// Clear the env vars so children don't inherit them accidentally
-	os.Unsetenv("APKG_FUSE_FD")
-	os.Unsetenv("APKG_MOUNT_POINT")
+	inheritLk.Lock()
+	defer inheritLk.Unlock()
 
-	return n, mountPoint
+	for _, mp := range mountPoints {
+		if n, ok := inherited[mp]; ok {
+			delete(inherited, mp)
+			return n, mp
+		}
+	}
+	return -1, ""
 }
 
 // GracefulExec replaces the current process with newBinary, preserving
 // the FUSE fd so the new process can pick up the mount seamlessly.
 func (s *FuseServer) GracefulExec(newBinary string) error {
-	log.Printf("apkgfs: graceful exec to %s (fd=%d, mount=%s)", newBinary, s.Fd, s.MountPoint)
+	return GracefulExec(newBinary, s)
+}
 
-	// Clear close-on-exec so the fd survives exec
-	_, _, errno := syscall.RawSyscall(syscall.SYS_FCNTL, uintptr(s.Fd), syscall.F_SETFD, 0)
-	if errno != 0 {
-		return fmt.Errorf("fcntl F_SETFD: %w", errno)
+// GracefulExec replaces the current process with newBinary, preserving the
+// FUSE fds of all the given servers.
+func GracefulExec(newBinary string, servers ...*FuseServer) error {
+	var fds, mps []string
+	for _, s := range servers {
+		log.Printf("apkgfs: graceful exec to %s (fd=%d, mount=%s)", newBinary, s.Fd, s.MountPoint)
+
+		// Clear close-on-exec so the fd survives exec
+		_, _, errno := syscall.RawSyscall(syscall.SYS_FCNTL, uintptr(s.Fd), syscall.F_SETFD, 0)
+		if errno != 0 {
+			return fmt.Errorf("fcntl F_SETFD: %w", errno)
+		}
+		fds = append(fds, strconv.Itoa(s.Fd))
+		mps = append(mps, s.MountPoint)
 	}
 
 	// Build environment with FUSE fd info
+	sep := string(os.PathListSeparator)
 	env := os.Environ()
-	env = setEnv(env, "APKG_FUSE_FD", strconv.Itoa(s.Fd))
-	env = setEnv(env, "APKG_MOUNT_POINT", s.MountPoint)
+	env = setEnv(env, "APKG_FUSE_FD", strings.Join(fds, sep))
+	env = setEnv(env, "APKG_MOUNT_POINT", strings.Join(mps, sep))
 
 	return syscall.Exec(newBinary, os.Args, env)
 }
 
 // doMount handles the full mount sequence for PkgFS, including inherited fd.
 func (res *PkgFS) doMount() error {
-	// Check for inherited fd from graceful restart
-	if fd, mp := inheritedFd(); fd >= 0 {
+	mkPath := filepath.Dir(res.mountPoint)
+	mkName := filepath.Base(res.mountPoint)
+
+	// Check for inherited fd from graceful restart, the actual mount point is
+	// the lower dir when an overlay is used
+	if fd, mp := inheritedFd(res.mountPoint, filepath.Join(mkPath, "."+mkName+"-ro")); fd >= 0 {
 		log.Printf("apkgfs: inheriting FUSE fd %d from previous process (mount=%s)", fd, mp)
 		res.fuseServer = newFuseServer(fd, mp, res)
 		return nil
 	}
 
 	// Fresh mount
-	mkPath := filepath.Dir(res.mountPoint)
-	mkName := filepath.Base(res.mountPoint)
 	mountOverlay := false
 	actualMountPoint := res.mountPoint
 
@@ -0,0 +1,156 @@
+package apkgsig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/KarpelesLab/hsm"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Databases can carry several signatures of the same header (signature
+// version 2):
+//
+//	uvarint version (2)
+//	uvarint count
+//	count × (varblob public key, varblob signature)
+//
+// A database is accepted if at least DbThreshold distinct keys trusted for
+// its name have signed it. A version 1 signature counts as one key.
+
+// maxDbSigners is the maximum number of signatures in a version 2 blob
+const maxDbSigners = 16
+
+var dbThreshold atomic.Int32
+
+func init() {
+	dbThreshold.Store(DefaultDbThreshold)
+}
+
+// SetDbThreshold sets the number of distinct trusted keys that must have
+// signed a database for it to be accepted. Values lower than 1 are ignored.
+func SetDbThreshold(n int) {
+	if n >= 1 {
+		dbThreshold.Store(int32(n))
+	}
+}
+
+// DbThreshold returns the number of signatures required on databases.
+func DbThreshold() int {
+	return int(dbThreshold.Load())
+}
+
+// MultiSignatureSize returns the maximum size of a version 2 signature blob
+// with n signatures.
+func MultiSignatureSize(n int) int {
+	return 2 + n*(2+ed25519.PublicKeySize+ed25519.SignatureSize)
+}
+
+// VerifyDb verifies the signature of database name against trusted database
+// signing keys, and checks enough keys trusted for this name have signed it.
+// If signers are given, only the trusted keys with one of these names count.
+// The returned result is the first trusted signer, with Signers set to the
+// number of distinct trusted keys.
+func VerifyDb(name string, data []byte, sig SigReader, signers ...string) (*VerifyResult, error) {
+	n, _ := binary.ReadUvarint(sig)
+
+	var res *VerifyResult
+	seen := make(map[string]bool)
+
+	switch n {
+	case 0x0001:
+		r, err := verifyEntry(data, sig, trustedDbSig, ScopeDb)
+		if err != nil {
+			return nil, err
+		}
+		if !r.Allows(name) || !AllowedSigner(r.Name, signers) {
+			return nil, fmt.Errorf("database %s signed by %s, which is not trusted for this name", name, r.Name)
+		}
+		res = r
+		seen[r.Key] = true
+	case 0x0002:
+		count, err := binary.ReadUvarint(sig)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 || count > maxDbSigners {
+			return nil, errors.New("invalid signature count")
+		}
+		for i := uint64(0); i < count; i++ {
+			r, err := verifyEntry(data, sig, trustedDbSig, ScopeDb)
+			if err == errUntrusted {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !r.Allows(name) || !AllowedSigner(r.Name, signers) || seen[r.Key] {
+				continue
+			}
+			seen[r.Key] = true
+			if res == nil {
+				res = r
+			}
+		}
+		if res == nil {
+			return nil, errUntrusted
+		}
+	default:
+		return nil, errors.New("unsupported database signature version")
+	}
+
+	res.Version = int(n)
+	res.Signers = len(seen)
+	if th := DbThreshold(); res.Signers < th {
+		return nil, fmt.Errorf("database %s signed by %d trusted keys, %d required", name, res.Signers, th)
+	}
+	return res, nil
+}
+
+// AllowedSigner returns true if name is in signers, or signers is empty.
+func AllowedSigner(name string, signers []string) bool {
+	if len(signers) == 0 {
+		return true
+	}
+	for _, s := range signers {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SignDb signs a database header. A single key produces a version 1
+// signature readable by all clients, several keys a version 2 signature.
+func SignDb(keys []hsm.Key, data []byte) ([]byte, error) {
+	switch len(keys) {
+	case 0:
+		return nil, errors.New("no signing key")
+	case 1:
+		return Sign(keys[0], data)
+	}
+	if len(keys) > maxDbSigners {
+		return nil, errors.New("too many signing keys")
+	}
+
+	sigB := &bytes.Buffer{}
+	sigB.Write(binary.AppendUvarint(nil, 0x0002))
+	sigB.Write(binary.AppendUvarint(nil, uint64(len(keys))))
+
+	for _, k := range keys {
+		s, err := Sign(k, data)
+		if err != nil {
+			return nil, err
+		}
+		// strip version 1 marker, keep public key and signature
+		sigB.Write(s[1:])
+	}
+
+	if sigB.Len() > MultiSignatureSize(len(keys)) {
+		return nil, errors.New("signature was too large")
+	}
+	return sigB.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package apkgsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testMultiSig builds a version 2 signature blob for data
+func testMultiSig(t *testing.T, data []byte, keys ...ed25519.PrivateKey) *bytes.Reader {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x02, byte(len(keys))})
+	for _, k := range keys {
+		WriteVarblob(buf, k.Public().(ed25519.PublicKey))
+		WriteVarblob(buf, ed25519.Sign(k, data))
+	}
+	if buf.Len() > MultiSignatureSize(len(keys)) {
+		t.Fatalf("signature size %d over %d", buf.Len(), MultiSignatureSize(len(keys)))
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestDbThreshold(t *testing.T) {
+	data := []byte("header")
+	dir := t.TempDir()
+	defer LoadTrustDir(t.TempDir())
+	defer SetDbThreshold(DefaultDbThreshold)
+
+	var keys []ed25519.PrivateKey
+	for i, scope := range []string{"db", "db", "db", "pkg"} {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, priv)
+		fn := filepath.Join(dir, string(rune('a'+i))+".json")
+		os.WriteFile(fn, []byte(`{"key":"`+base64.RawURLEncoding.EncodeToString(pub)+`","scope":"`+scope+`"}`), 0644)
+	}
+	if err := LoadTrustDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	SetDbThreshold(2)
+
+	if _, err := VerifyDb("main", data, testSig(t, keys[0], data)); err == nil {
+		t.Error("single signature accepted with a threshold of 2")
+	}
+	if _, err := VerifyDb("main", data, testMultiSig(t, data, keys[0], keys[0])); err == nil {
+		t.Error("same key counted twice")
+	}
+	if _, err := VerifyDb("main", data, testMultiSig(t, data, keys[0], keys[3])); err == nil {
+		t.Error("package key counted for database")
+	}
+	res, err := VerifyDb("main", data, testMultiSig(t, data, keys[3], keys[1], keys[2]))
+	if err != nil {
+		t.Fatalf("2 of 3 signatures failed: %s", err)
+	}
+	if res.Version != 2 || res.Signers != 2 || res.Name != "b" {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// only the named signers count
+	if _, err := VerifyDb("main", data, testMultiSig(t, data, keys[0], keys[1]), "a", "c"); err == nil {
+		t.Error("signature from a key outside the signers accepted")
+	}
+	if _, err := VerifyDb("main", data, testMultiSig(t, data, keys[0], keys[2]), "a", "c"); err != nil {
+		t.Errorf("signatures from the signers refused: %s", err)
+	}
+
+	// a bad signature fails the whole blob
+	if _, err := VerifyDb("main", []byte("other"), testMultiSig(t, data, keys[0], keys[1])); err == nil {
+		t.Error("invalid signatures accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package apkgsig
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/KarpelesLab/hsm"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// softKey is an ed25519 private key held in memory, for signing without a
+// HSM (build containers, tests).
+type softKey struct {
+	priv ed25519.PrivateKey
+	src  string
+}
+
+var _ hsm.Key = (*softKey)(nil)
+
+// NewKey returns a hsm.Key signing with the given ed25519 private key.
+func NewKey(priv ed25519.PrivateKey, src string) hsm.Key {
+	return &softKey{priv: priv, src: src}
+}
+
+// LoadKey loads a signing key from spec, which is either the path of an
+// unencrypted ed25519 private key (PKCS#8 PEM or OpenSSH format), or
+// "env:NAME" to read a 32 bytes seed encoded in hex or base64 from the
+// environment variable NAME.
+func LoadKey(spec string) (hsm.Key, error) {
+	if name, ok := strings.CutPrefix(spec, "env:"); ok {
+		v := strings.TrimSpace(os.Getenv(name))
+		if v == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		seed, err := decodeSeed(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return NewKey(ed25519.NewKeyFromSeed(seed), spec), nil
+	}
+
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", spec, err)
+	}
+	switch k := raw.(type) {
+	case ed25519.PrivateKey:
+		return NewKey(k, spec), nil
+	case *ed25519.PrivateKey:
+		return NewKey(*k, spec), nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 key (%T)", spec, raw)
+}
+
+// decodeSeed accepts a seed encoded as hex, or base64 with either alphabet
+func decodeSeed(v string) ([]byte, error) {
+	for _, dec := range []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+	} {
+		if seed, err := dec(v); err == nil && len(seed) == ed25519.SeedSize {
+			return seed, nil
+		}
+	}
+	return nil, errors.New("seed must be 32 bytes encoded in hex or base64")
+}
+
+func (k *softKey) Public() crypto.PublicKey {
+	return k.priv.Public()
+}
+
+func (k *softKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.priv.Sign(rand, digest, opts)
+}
+
+// PublicBlob returns the raw ed25519 public key, as used in signatures.
+func (k *softKey) PublicBlob() ([]byte, error) {
+	return []byte(k.priv.Public().(ed25519.PublicKey)), nil
+}
+
+func (k *softKey) String() string {
+	return fmt.Sprintf("ed25519 key(%s)", k.src)
+}
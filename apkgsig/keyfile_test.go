@@ -0,0 +1,63 @@
+package apkgsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)
+
+	sshBlock, err := ssh.MarshalPrivateKey(priv, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshFile := filepath.Join(dir, "id_ed25519")
+	os.WriteFile(sshFile, pem.EncodeToMemory(sshBlock), 0600)
+
+	t.Setenv("APKG_TEST_SEED", hex.EncodeToString(priv.Seed()))
+
+	for _, spec := range []string{pemFile, sshFile, "env:APKG_TEST_SEED"} {
+		k, err := LoadKey(spec)
+		if err != nil {
+			t.Errorf("LoadKey(%s) failed: %s", spec, err)
+			continue
+		}
+		blob, _ := k.PublicBlob()
+		if !bytes.Equal(blob, pub) {
+			t.Errorf("LoadKey(%s): wrong public key", spec)
+		}
+
+		sig, err := Sign(k, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig) > SignatureSize || !ed25519.Verify(pub, []byte("data"), sig[len(sig)-ed25519.SignatureSize:]) {
+			t.Errorf("LoadKey(%s): bad signature", spec)
+		}
+	}
+
+	if _, err := LoadKey("env:APKG_TEST_MISSING"); err == nil {
+		t.Error("missing environment variable should fail")
+	}
+}
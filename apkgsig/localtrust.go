@@ -0,0 +1,128 @@
+package apkgsig
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Keys can be trusted in addition to the compiled-in ones by placing one JSON
+// file per key in a trust directory (/etc/apkg/trust.d by default):
+//
+//	{"key": "<base64url ed25519 public key>", "name": "Our Corp", "scope": "pkg", "prefix": "ourcorp.*"}
+//
+// scope is "pkg", "db" or "both". When prefix is set, the key is only trusted
+// for packages or databases whose name starts with it (a trailing "*" is
+// ignored).
+
+// Key scopes
+const (
+	ScopePkg  = "pkg"
+	ScopeDb   = "db"
+	ScopeBoth = "both"
+)
+
+// TrustedKey is a signing key trusted through the local trust directory.
+type TrustedKey struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Scope  string `json:"scope"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+var (
+	localTrust   = make(map[string]*TrustedKey)
+	localTrustLk sync.RWMutex
+)
+
+// LoadTrustDir replaces the locally trusted keys with the *.json files found
+// in dir. A missing directory means no local keys. Invalid files are skipped
+// and reported in the returned error, the other keys are still loaded.
+func LoadTrustDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*TrustedKey)
+	var errs []error
+
+	for _, fn := range files {
+		k, err := readTrustedKey(fn)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", fn, err))
+			continue
+		}
+		keys[k.Key] = k
+	}
+
+	localTrustLk.Lock()
+	localTrust = keys
+	localTrustLk.Unlock()
+
+	return errors.Join(errs...)
+}
+
+func readTrustedKey(fn string) (*TrustedKey, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	k := &TrustedKey{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+
+	pub, err := base64.RawURLEncoding.DecodeString(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid key length")
+	}
+
+	switch k.Scope {
+	case ScopePkg, ScopeDb, ScopeBoth:
+	default:
+		return nil, fmt.Errorf("invalid scope %q", k.Scope)
+	}
+
+	k.Prefix = strings.TrimSuffix(k.Prefix, "*")
+	if k.Name == "" {
+		k.Name = strings.TrimSuffix(filepath.Base(fn), ".json")
+	}
+	return k, nil
+}
+
+// LocalKeys returns the keys loaded from the trust directory.
+func LocalKeys() []TrustedKey {
+	localTrustLk.RLock()
+	defer localTrustLk.RUnlock()
+
+	res := make([]TrustedKey, 0, len(localTrust))
+	for _, k := range localTrust {
+		res = append(res, *k)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// localKey returns the local key k if it is trusted for scope
+func localKey(k, scope string) *TrustedKey {
+	localTrustLk.RLock()
+	defer localTrustLk.RUnlock()
+
+	t, ok := localTrust[k]
+	if !ok || (t.Scope != scope && t.Scope != ScopeBoth) {
+		return nil
+	}
+	return t
+}
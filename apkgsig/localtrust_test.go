@@ -0,0 +1,82 @@
+package apkgsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testSig builds a version 1 signature blob for data
+func testSig(t *testing.T, priv ed25519.PrivateKey, data []byte) *bytes.Reader {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	buf.WriteByte(0x01)
+	if err := WriteVarblob(buf, priv.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteVarblob(buf, ed25519.Sign(priv, data)); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestLocalTrust(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.RawURLEncoding.EncodeToString(pub)
+	data := []byte("header")
+
+	dir := t.TempDir()
+	defer LoadTrustDir(t.TempDir())
+
+	// unknown key
+	if _, err := VerifyPkg(data, testSig(t, priv, data)); err == nil {
+		t.Fatal("signature from unknown key should have failed")
+	}
+
+	os.WriteFile(filepath.Join(dir, "ourcorp.json"), []byte(`{"key":"`+key+`","scope":"pkg","prefix":"ourcorp.*"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"key":"AAAA","scope":"pkg"}`), 0644)
+	if err := LoadTrustDir(dir); err == nil {
+		t.Error("expected an error for bad.json")
+	}
+
+	res, err := VerifyPkg(data, testSig(t, priv, data))
+	if err != nil {
+		t.Fatalf("signature from local key failed: %s", err)
+	}
+	if res.Name != "ourcorp" {
+		t.Errorf("unexpected key name %q", res.Name)
+	}
+	if !res.Allows("ourcorp.tools.core.1.0.linux.amd64") || res.Allows("sys-libs.glibc.libs.2.41.linux.amd64") {
+		t.Error("prefix not applied")
+	}
+
+	// package keys are not trusted for databases
+	if _, err := VerifyDb("main", data, testSig(t, priv, data)); err == nil {
+		t.Error("package key should not be trusted for databases")
+	}
+	if TrustedDbKey(key) != nil {
+		t.Error("package key returned by TrustedDbKey")
+	}
+
+	// reloading replaces the previous keys
+	os.WriteFile(filepath.Join(dir, "ourcorp.json"), []byte(`{"key":"`+key+`","name":"Our Corp","scope":"both"}`), 0644)
+	os.Remove(filepath.Join(dir, "bad.json"))
+	if err := LoadTrustDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	res, err = VerifyDb("main", data, testSig(t, priv, data))
+	if err != nil {
+		t.Fatalf("signature from local db key failed: %s", err)
+	}
+	if res.Name != "Our Corp" || !res.Allows("main") {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
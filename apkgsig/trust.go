@@ -6,6 +6,10 @@ var trustedDbSig = map[string]string{
 	"TPDBy98_HUS9JikdsjCbw_FjUjNWTx5ryNron_DHEBA": "APDB emergency key #1",
 }
 
+// DefaultDbThreshold is the number of trusted keys that must have signed a
+// database. It stays at 1 until all databases carry several signatures.
+const DefaultDbThreshold = 1
+
 var trustedPkgSig = map[string]string{
 	"n21_CiuzEuo_OaSfEVodAXpQtcc4Qe_NprMSAs3B9QU": "Mark Karpeles <magicaltux@gmail.com>",
 	"TPKGBiS_JH8tnSUgAE-4_f8gOkvzFqR2dnOKrJyLRus": "APKG emergency key #1",
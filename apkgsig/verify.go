@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"strings"
 
 	"golang.org/x/crypto/ed25519"
 )
@@ -23,6 +24,15 @@ type VerifyResult struct {
 	Version int    // Signature format version
 	Key     string // Base64-encoded public key
 	Name    string // Name of the trusted signer
+	Prefix  string // If set, the key is only trusted for names starting with it
+	Signers int    // Number of distinct trusted keys that signed
+}
+
+// Allows returns true if the signing key is trusted for the given package or
+// database name. Compiled-in keys are trusted for any name, keys from the
+// local trust directory may be limited to a prefix.
+func (r *VerifyResult) Allows(name string) bool {
+	return strings.HasPrefix(name, r.Prefix)
 }
 
 // SignatureSize is the maximum size of a signature blob in bytes.
@@ -31,33 +41,61 @@ type VerifyResult struct {
 const SignatureSize = 3 + ed25519.PublicKeySize + ed25519.SignatureSize
 
 // VerifyPkg verifies a package signature against trusted package signing keys.
-// Returns an error if the signature is invalid or from an untrusted key.
+// Returns an error if the signature is invalid or from an untrusted key. The
+// caller must check the package name with Allows once it is known.
 func VerifyPkg(data []byte, sig SigReader) (*VerifyResult, error) {
-	return verify(data, sig, trustedPkgSig)
-}
-
-// VerifyDb verifies a database signature against trusted database signing keys.
-// Returns an error if the signature is invalid or from an untrusted key.
-func VerifyDb(data []byte, sig SigReader) (*VerifyResult, error) {
-	return verify(data, sig, trustedDbSig)
+	return verify(data, sig, trustedPkgSig, ScopePkg)
 }
 
 // DbKeyName returns the name associated with a trusted database signing key,
 // or an empty string if the key is not trusted.
 func DbKeyName(k string) string {
-	name, found := trustedDbSig[k]
-	if !found {
-		return ""
+	if r := TrustedDbKey(k); r != nil {
+		return r.Name
+	}
+	return ""
+}
+
+// TrustedDbKey returns the trust information for a database signing key, or
+// nil if the key is not trusted.
+func TrustedDbKey(k string) *VerifyResult {
+	return trusted(k, trustedDbSig, ScopeDb)
+}
+
+// trusted looks up k in the compiled-in keys, then in the local trust store
+func trusted(k string, trust map[string]string, scope string) *VerifyResult {
+	if name, ok := trust[k]; ok {
+		return &VerifyResult{Key: k, Name: name}
 	}
-	return name
+	if t := localKey(k, scope); t != nil {
+		return &VerifyResult{Key: k, Name: t.Name, Prefix: t.Prefix}
+	}
+	return nil
 }
 
-func verify(data []byte, sigB SigReader, trust map[string]string) (*VerifyResult, error) {
+var errUntrusted = errors.New("valid signature from non trusted key")
+
+func verify(data []byte, sigB SigReader, trust map[string]string, scope string) (*VerifyResult, error) {
 	n, _ := binary.ReadUvarint(sigB)
 	if n != 0x0001 {
 		return nil, errors.New("unsupported package signature version")
 	}
 
+	res, err := verifyEntry(data, sigB, trust, scope)
+	if err != nil {
+		return nil, err
+	}
+	res.Version = int(n)
+	res.Signers = 1
+
+	//log.Printf("apkgsig: Verified valid signature by %s (%s)", res.Name, res.Key)
+
+	return res, nil
+}
+
+// verifyEntry reads a public key and signature pair and checks it. It returns
+// errUntrusted if the signature is valid but the key is not trusted.
+func verifyEntry(data []byte, sigB SigReader, trust map[string]string, scope string) (*VerifyResult, error) {
 	// read pubkey
 	pub, err := ReadVarblob(sigB, ed25519.PublicKeySize)
 	if err != nil {
@@ -71,24 +109,14 @@ func verify(data []byte, sigB SigReader, trust map[string]string) (*VerifyResult
 	}
 
 	// check sig
-	if !ed25519.Verify(ed25519.PublicKey(pub), data, blob) {
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pub), data, blob) {
 		return nil, errors.New("invalid signature")
 	}
 
 	// check trust data
-	keyS := base64.RawURLEncoding.EncodeToString(pub)
-	keyN, ok := trust[keyS]
-	if !ok {
-		return nil, errors.New("valid signature from non trusted key")
+	res := trusted(base64.RawURLEncoding.EncodeToString(pub), trust, scope)
+	if res == nil {
+		return nil, errUntrusted
 	}
-
-	//log.Printf("apkgsig: Verified valid signature by %s (%s)", keyN, keyS)
-
-	res := &VerifyResult{
-		Version: int(n),
-		Key:     keyS,
-		Name:    keyN,
-	}
-
 	return res, nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/AzusaOS/apkg/apkgdb"
+)
+
+// exportBundle writes a bundle of the latest database and the given packages
+// to fn ("-" for stdout), for use on machines without network access.
+func exportBundle(c *dbConfig, fn string, names []string) error {
+	// use a temporary database, so this works while the daemon is running
+	tmp, err := os.MkdirTemp("", "apkgbundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	d, err := apkgdb.NewExport(c.mirrorList(), c.Name, tmp)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.SetChannel(c.channel())
+	d.SetSigners(c.Signers)
+	loadPinOverrides(d)
+
+	var out io.Writer = os.Stdout
+	if fn != "-" {
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return d.ExportBundle(out, names)
+}
+
+// importBundle loads a bundle created with -export_bundle into d.
+func importBundle(d *apkgdb.DB, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return d.ImportBundle(f)
+}
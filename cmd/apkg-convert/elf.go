@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// neededLibs scans the ELF files of a package and returns the sonames they
+// need (DT_NEEDED) that are not provided by the package itself, sorted.
+// These have to be found through ld.so.cache at runtime, and are used by the
+// daemon to fetch the packages providing them in advance.
+func neededLibs(fsys fs.FS) ([]string, error) {
+	needed := make(map[string]bool)
+	provided := make(map[string]bool)
+
+	err := fs.WalkDir(fsys, ".", func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		// any file or symlink with the name of a soname satisfies it
+		provided[path.Base(p)] = true
+		if !de.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return nil
+		}
+		magic := make([]byte, 4)
+		if _, err := ra.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, []byte(elf.ELFMAG)) {
+			return nil
+		}
+		ef, err := elf.NewFile(ra)
+		if err != nil {
+			// not something we can parse, ignore
+			return nil
+		}
+		libs, _ := ef.ImportedLibraries()
+		for _, lib := range libs {
+			needed[lib] = true
+		}
+		sonames, _ := ef.DynString(elf.DT_SONAME)
+		for _, soname := range sonames {
+			provided[soname] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for lib := range needed {
+		if !provided[lib] {
+			res = append(res, lib)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNeededLibs(t *testing.T) {
+	bin, err := os.ReadFile("/bin/ls")
+	if err != nil {
+		t.Skip("no /bin/ls to use as ELF sample")
+	}
+	ef, err := elf.Open("/bin/ls")
+	if err != nil {
+		t.Skip("/bin/ls is not an ELF file")
+	}
+	libs, _ := ef.ImportedLibraries()
+	ef.Close()
+	if len(libs) < 2 {
+		t.Skip("/bin/ls does not need enough shared libraries")
+	}
+	slices.Sort(libs)
+
+	fsys := fstest.MapFS{
+		"bin/ls":           {Data: bin, Mode: 0755},
+		"bin/script":       {Data: []byte("#!/bin/sh\n"), Mode: 0755},
+		"share/empty":      {Data: nil},
+		"lib64/" + libs[0]: {Data: []byte("not really a library")},
+	}
+
+	res, err := neededLibs(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first library is in the package, so it is not needed
+	if !slices.Equal(res, libs[1:]) {
+		t.Errorf("expected %v, got %v", libs[1:], res)
+	}
+}
@@ -2,32 +2,62 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
+	"github.com/AzusaOS/apkg/apkgsig"
 	"github.com/KarpelesLab/hsm"
 )
 
-func main() {
-	flag.Parse()
-	h, err := hsm.New()
+var (
+	keyFile = flag.String("key", "", "sign with this ed25519 private key file (PEM or OpenSSH), or env:NAME to read a seed from the environment, instead of the HSM")
+	repoDir = flag.String("repo", defaultRepo(), "repository root, packages are written to <repo>/<db>/<layout>/ (default $APKG_REPO)")
+	dbName  = flag.String("db", "main", "database the packages are built for")
+	layout  = flag.String("layout", "{cat}/{name}/{subcat}", "directory of packages in the database, using {cat}, {name}, {subcat}, {version}, {os} and {arch}")
+)
+
+// defaultRepo returns $APKG_REPO, or the historical location of the
+// repository in the home directory
+func defaultRepo() string {
+	if r := os.Getenv("APKG_REPO"); r != "" {
+		return r
+	}
+	return filepath.Join(os.Getenv("HOME"), "projects/apkg-tools/repo/apkg/dist")
+}
 
+// getKey returns the package signing key, from -key or the HSM
+func getKey() (hsm.Key, error) {
+	if *keyFile != "" {
+		return apkgsig.LoadKey(*keyFile)
+	}
+
+	h, err := hsm.New()
 	if err != nil {
-		log.Printf("failed to initialize HSM: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to initialize HSM: %w", err)
 	}
 
 	ks, err := h.ListKeysByName("pkg_sign_ed25519")
 	if err != nil {
-		log.Printf("failed to list HSM keys: %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to list HSM keys: %w", err)
 	} else if len(ks) == 0 {
-		log.Printf("failed to list HSM keys: no keys. Please generate one.")
+		return nil, errors.New("failed to list HSM keys: no keys. Please generate one")
+	}
+	return ks[0], nil
+}
+
+func main() {
+	flag.Parse()
+
+	k, err := getKey()
+	if err != nil {
+		log.Printf("%s", err)
 		os.Exit(1)
 	}
 
-	k := ks[0]
 	log.Printf("found key: %s", k)
 	blob, err := k.PublicBlob()
 	if err == nil {
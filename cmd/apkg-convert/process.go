@@ -214,6 +214,16 @@ func process(k hsm.Key, filename string) error {
 
 	metadata.Provides = provides
 
+	// shared libraries to be found through ld.so.cache
+	needed, err := neededLibs(sb)
+	if err != nil {
+		return fmt.Errorf("while scanning ELF files: %w", err)
+	}
+	for _, lib := range needed {
+		log.Printf("needs: %s", lib)
+	}
+	metadata.Needed = needed
+
 	metadataJson, err := json.Marshal(metadata)
 	if err != nil {
 		return err
@@ -323,7 +333,11 @@ func process(k hsm.Key, filename string) error {
 	headerHashHex := hex.EncodeToString(headerHash[:])
 
 	// generate output filename
-	out := filepath.Join(os.Getenv("HOME"), "projects/apkg-tools/repo/apkg/dist/main", strings.Join(fn_a, "/"), filename_f+"-"+headerHashHex[:7]+".apkg")
+	dir, err := layoutDir(*layout, cat_s, name_s, subcat_s, fn_v, os_s, arch_s)
+	if err != nil {
+		return err
+	}
+	out := filepath.Join(*repoDir, *dbName, dir, filename_f+"-"+headerHashHex[:7]+".apkg")
 	log.Printf("out filename = %s", out)
 
 	err = os.MkdirAll(filepath.Dir(out), 0755)
@@ -366,6 +380,27 @@ func process(k hsm.Key, filename string) error {
 	return nil
 }
 
+// layoutDir expands the -layout template for a package, and returns the
+// directory relative to the database root.
+func layoutDir(layout, cat, name, subcat string, version []string, osStr, archStr string) (string, error) {
+	r := strings.NewReplacer(
+		"{cat}", cat,
+		"{name}", name,
+		"{subcat}", subcat,
+		"{version}", strings.Join(version, "."),
+		"{os}", osStr,
+		"{arch}", archStr,
+	)
+	res := path.Clean(r.Replace(layout))
+	if strings.ContainsAny(res, "{}") {
+		return "", fmt.Errorf("invalid layout %q: unknown placeholder", layout)
+	}
+	if path.IsAbs(res) || res == ".." || strings.HasPrefix(res, "../") {
+		return "", fmt.Errorf("invalid layout %q: must stay within the database directory", layout)
+	}
+	return filepath.FromSlash(res), nil
+}
+
 // parsePackageFilename parses a package filename of the form
 // "cat.name.subcat.version_parts.os.arch" into its components.
 // It requires at least 5 dot-separated components.
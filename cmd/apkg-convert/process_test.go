@@ -102,3 +102,34 @@ func TestParsePackageFilename(t *testing.T) {
 		})
 	}
 }
+
+func TestLayoutDir(t *testing.T) {
+	tests := []struct {
+		layout  string
+		want    string
+		wantErr bool
+	}{
+		{layout: "{cat}/{name}/{subcat}", want: "core/foobar/libs"},
+		{layout: "{os}/{arch}/{cat}.{name}", want: "linux/amd64/core.foobar"},
+		{layout: "{name}/{version}", want: "foobar/1.2.3"},
+		{layout: "", want: "."},
+		{layout: "{category}", wantErr: true},
+		{layout: "../{name}", wantErr: true},
+		{layout: "/srv/{name}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := layoutDir(tt.layout, "core", "foobar", "libs", []string{"1", "2", "3"}, "linux", "amd64")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("layoutDir(%q) = %q, expected error", tt.layout, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("layoutDir(%q) failed: %s", tt.layout, err)
+		} else if got != tt.want {
+			t.Errorf("layoutDir(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
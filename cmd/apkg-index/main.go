@@ -2,39 +2,115 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/AzusaOS/apkg/apkgdb"
+	"github.com/AzusaOS/apkg/apkgsig"
 	"github.com/KarpelesLab/hsm"
 )
 
+var (
+	keyFiles    = flag.String("key", "", "comma separated list of ed25519 private key files (PEM or OpenSSH), or env:NAME to read a seed from the environment, to sign with instead of the HSM")
+	repoDir     = flag.String("repo", defaultRepo(), "repository root, packages are read from <repo>/<db>/ (default $APKG_REPO)")
+	dbName      = flag.String("db", "main", "name of the database to build")
+	mirrors     = flag.String("mirrors", apkgdb.PKG_URL_PREFIX, "comma separated list of URL prefixes to download the current database from, empty to start from an empty database")
+	workDir     = flag.String("work", "", "directory keeping the databases and recent exports between runs (default a temporary directory)")
+	keepExports = flag.Int("keep", 24, "number of exports kept in -work, deltas are generated from the previous ones (requires -work)")
+	publish     = flag.String("publish", "s3://azusa", "where to publish the database: s3://bucket/prefix, a local directory, dry-run, or empty to only export")
+)
+
+// defaultRepo returns $APKG_REPO, or the historical location of the
+// repository in the home directory
+func defaultRepo() string {
+	if r := os.Getenv("APKG_REPO"); r != "" {
+		return r
+	}
+	return filepath.Join(os.Getenv("HOME"), "projects/apkg-tools/repo/apkg/dist")
+}
+
+// getKeys returns the database signing keys, from -key or the HSM
+func getKeys() ([]hsm.Key, error) {
+	if *keyFiles != "" {
+		var ks []hsm.Key
+		for _, spec := range strings.Split(*keyFiles, ",") {
+			k, err := apkgsig.LoadKey(spec)
+			if err != nil {
+				return nil, err
+			}
+			ks = append(ks, k)
+		}
+		return ks, nil
+	}
+
+	h, err := hsm.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize HSM: %w", err)
+	}
+
+	ks, err := h.ListKeysByName("tpdb_sign_ed25519")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HSM keys: %w", err)
+	} else if len(ks) == 0 {
+		return nil, errors.New("failed to list HSM keys: no keys. Please generate one")
+	}
+	return ks, nil
+}
+
 func main() {
 	flag.Parse()
-	h, err := hsm.New()
 
+	if *workDir == "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "keep" {
+				log.Printf("-keep requires -work, exports are not kept in a temporary directory")
+				os.Exit(1)
+			}
+		})
+	}
+
+	if flag.Arg(0) == "pin" {
+		if err := pinCommand(*dbName, flag.Args()[1:]); err != nil {
+			log.Printf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "revoke" {
+		if err := revokeCommand(*dbName, flag.Args()[1:]); err != nil {
+			log.Printf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ks, err := getKeys()
 	if err != nil {
-		log.Printf("failed to initialize HSM: %s", err)
+		log.Printf("%s", err)
 		os.Exit(1)
 	}
 
-	ks, err := h.ListKeysByName("tpdb_sign_ed25519")
+	pub, err := apkgdb.ParsePublisher(*publish)
 	if err != nil {
-		log.Printf("failed to list HSM keys: %s", err)
-		os.Exit(1)
-	} else if len(ks) == 0 {
-		log.Printf("failed to list HSM keys: no keys. Please generate one.")
+		log.Printf("%s", err)
 		os.Exit(1)
 	}
 
-	k := ks[0]
-	log.Printf("found APDB key: %s", k)
-	blob, err := k.PublicBlob()
-	if err == nil {
-		log.Printf("Public key: %s", base64.RawURLEncoding.EncodeToString(blob))
+	// all keys sign the database, see apkgsig.SignDb
+	for _, k := range ks {
+		log.Printf("found APDB key: %s", k)
+		blob, err := k.PublicBlob()
+		if err == nil {
+			log.Printf("Public key: %s", base64.RawURLEncoding.EncodeToString(blob))
+		}
 	}
 
-	err = processDb("main", k)
+	err = processDb(*dbName, ks, pub)
 	if err != nil {
 		log.Printf("failed: %s", err)
 	}
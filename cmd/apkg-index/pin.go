@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/AzusaOS/apkg/apkgdb"
+)
+
+var (
+	pinTargets = flag.String("targets", "", "pin and revoke commands: comma separated list of os/arch databases to change (default all found in the repository)")
+	assumeYes  = flag.Bool("yes", false, "pin and revoke commands: export without asking for confirmation")
+)
+
+const pinUsage = `usage:
+	apkg-index [flags] pin list [channel]
+	apkg-index [flags] pin set <channel> <prefix> <version>
+	apkg-index [flags] pin rm <channel> <prefix>
+	apkg-index [flags] pin promote <from> <to>`
+
+// pinChange is a difference between the pins of two database states
+type pinChange struct {
+	channel, prefix string
+	old, new        string // empty when the pin does not exist
+}
+
+func (c pinChange) String() string {
+	switch {
+	case c.old == "":
+		return fmt.Sprintf("+ %s %s = %s", c.channel, c.prefix, c.new)
+	case c.new == "":
+		return fmt.Sprintf("- %s %s (was %s)", c.channel, c.prefix, c.old)
+	}
+	return fmt.Sprintf("~ %s %s: %s → %s", c.channel, c.prefix, c.old, c.new)
+}
+
+// diffPins returns the changes between two sets of pins (channel → prefix →
+// version), sorted by channel and prefix.
+func diffPins(before, after map[string]map[string]string) []pinChange {
+	var res []pinChange
+	for ch, pins := range after {
+		for pfx, v := range pins {
+			if old := before[ch][pfx]; old != v {
+				res = append(res, pinChange{channel: ch, prefix: pfx, old: old, new: v})
+			}
+		}
+	}
+	for ch, pins := range before {
+		for pfx, v := range pins {
+			if _, ok := after[ch][pfx]; !ok {
+				res = append(res, pinChange{channel: ch, prefix: pfx, old: v})
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].channel != res[j].channel {
+			return res[i].channel < res[j].channel
+		}
+		return res[i].prefix < res[j].prefix
+	})
+	return res
+}
+
+// applyPinCommand changes the pins of db according to args
+func applyPinCommand(db *apkgdb.DB, args []string) error {
+	switch args[0] {
+	case "set":
+		if len(args) != 4 {
+			return errors.New(pinUsage)
+		}
+		return db.SetPin(args[1], args[2], args[3])
+	case "rm":
+		if len(args) != 3 {
+			return errors.New(pinUsage)
+		}
+		if db.GetPin(args[1], args[2]) == "" {
+			return fmt.Errorf("no pin for %s in channel %s", args[2], args[1])
+		}
+		return db.DeletePin(args[1], args[2])
+	case "promote":
+		if len(args) != 3 || args[1] == args[2] {
+			return errors.New(pinUsage)
+		}
+		// copy the pins, pins only in the target channel are kept
+		for pfx, v := range db.ListPins(args[1]) {
+			if err := db.SetPin(args[2], pfx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New(pinUsage)
+}
+
+// pinCommand runs the pin subcommand on all the target databases, and
+// exports the databases that changed once confirmed.
+func pinCommand(name string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(pinUsage)
+	}
+
+	return editDatabases(name, args[0] == "list", func(fk fileKey, db *apkgdb.DB) (bool, error) {
+		if args[0] == "list" {
+			if len(args) > 2 {
+				return false, errors.New(pinUsage)
+			}
+			listPins(os.Stdout, fk, db.AllPins(), args[1:])
+			return false, nil
+		}
+
+		before := db.AllPins()
+		if err := applyPinCommand(db, args); err != nil {
+			return false, err
+		}
+		return printChanges(fk, diffPins(before, db.AllPins())), nil
+	})
+}
+
+// printChanges shows the changes made to a database, and returns true if
+// there are any.
+func printChanges[T fmt.Stringer](fk fileKey, diff []T) bool {
+	if len(diff) == 0 {
+		fmt.Printf("%s/%s: no change\n", fk.os, fk.arch)
+		return false
+	}
+	fmt.Printf("%s/%s:\n", fk.os, fk.arch)
+	for _, c := range diff {
+		fmt.Printf("  %s\n", c)
+	}
+	return true
+}
+
+// editDatabases calls edit on all the target databases, and exports the
+// databases it changed once confirmed. Nothing is exported if readOnly is
+// true.
+func editDatabases(name string, readOnly bool, edit func(fk fileKey, db *apkgdb.DB) (bool, error)) error {
+	targets, err := pinTargetList(name)
+	if err != nil {
+		return err
+	}
+
+	var pub apkgdb.Publisher
+	if !readOnly {
+		pub, err = apkgdb.ParsePublisher(*publish)
+		if err != nil {
+			return err
+		}
+	}
+
+	tempDir, cleanup, err := workDirectory(pub == nil && !readOnly)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	changed := make(map[fileKey]*apkgdb.DB)
+	for _, fk := range targets {
+		db, err := apkgdb.NewOsArch(*mirrors, name, path.Join(tempDir, fk.os, fk.arch), fk.os, fk.arch)
+		if err != nil {
+			return err
+		}
+
+		ok, err := edit(fk, db)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", fk.os, fk.arch, err)
+		}
+		if ok {
+			db.SetKeepExports(keptExports())
+			changed[fk] = db
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+	if !*assumeYes && !confirm(os.Stdin, "Sign and publish these changes?") {
+		return errors.New("aborted")
+	}
+
+	ks, err := getKeys()
+	if err != nil {
+		return err
+	}
+	for _, db := range changed {
+		if err := db.Export(pub, ks...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listPins(w io.Writer, fk fileKey, pins map[string]map[string]string, channel []string) {
+	var channels []string
+	for ch := range pins {
+		if len(channel) == 0 || channel[0] == ch {
+			channels = append(channels, ch)
+		}
+	}
+	sort.Strings(channels)
+
+	fmt.Fprintf(w, "%s/%s:\n", fk.os, fk.arch)
+	for _, ch := range channels {
+		var prefixes []string
+		for pfx := range pins[ch] {
+			prefixes = append(prefixes, pfx)
+		}
+		sort.Strings(prefixes)
+		for _, pfx := range prefixes {
+			fmt.Fprintf(w, "  %s %s = %s\n", ch, pfx, pins[ch][pfx])
+		}
+	}
+}
+
+// pinTargetList returns the databases to change, from -targets or the
+// packages found in the repository.
+func pinTargetList(name string) ([]fileKey, error) {
+	if *pinTargets != "" {
+		var res []fileKey
+		for _, t := range strings.Split(*pinTargets, ",") {
+			o, a, ok := strings.Cut(strings.TrimSpace(t), "/")
+			if !ok || o == "" || a == "" {
+				return nil, fmt.Errorf("invalid target %q, expected os/arch", t)
+			}
+			res = append(res, fileKey{os: o, arch: a})
+		}
+		return res, nil
+	}
+
+	found := make(map[fileKey]bool)
+	re := regexp.MustCompile(`\.([a-z]+)\.([a-z0-9]+)-[a-f0-9]{7}\.apkg$`)
+	err := filepath.WalkDir(filepath.Join(*repoDir, name), func(fpath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if r := re.FindStringSubmatch(d.Name()); r != nil {
+			found[fileKey{os: r[1], arch: r[2]}] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errors.New("no package found in repository, use -targets")
+	}
+
+	res := make([]fileKey, 0, len(found))
+	for fk := range found {
+		res = append(res, fk)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].os != res[j].os {
+			return res[i].os < res[j].os
+		}
+		return res[i].arch < res[j].arch
+	})
+	return res, nil
+}
+
+// confirm asks a yes/no question, defaulting to no
+func confirm(r io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffPins(t *testing.T) {
+	before := map[string]map[string]string{
+		"stable":  {"sys-libs.glibc": "2.40", "dev-lang.python": "3.11"},
+		"testing": {"sys-libs.glibc": "2.41"},
+	}
+	after := map[string]map[string]string{
+		"stable":  {"sys-libs.glibc": "2.41", "dev-lang.go": "1.25"},
+		"testing": {"sys-libs.glibc": "2.41"},
+	}
+
+	var got []string
+	for _, c := range diffPins(before, after) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"+ stable dev-lang.go = 1.25",
+		"- stable dev-lang.python (was 3.11)",
+		"~ stable sys-libs.glibc: 2.40 → 2.41",
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	if d := diffPins(after, after); len(d) != 0 {
+		t.Errorf("expected no change, got %v", d)
+	}
+}
@@ -17,15 +17,41 @@ type fileKey struct {
 	os   string
 }
 
-func processDb(name string, k hsm.Key) error {
-	// instanciate db
+// workDirectory returns -work, or a new temporary directory which is removed
+// by cleanup unless keep is set.
+func workDirectory(keep bool) (string, func(), error) {
+	if *workDir != "" {
+		return *workDir, func() {}, nil
+	}
 	tempDir, err := os.MkdirTemp("", "apkgidx")
+	if err != nil {
+		return "", nil, err
+	}
+	if keep {
+		log.Printf("Exporting to %s", tempDir)
+		return tempDir, func() {}, nil
+	}
+	return tempDir, func() { os.RemoveAll(tempDir) }, nil
+}
+
+// keptExports returns -keep, or zero without -work as a temporary directory
+// has no previous exports to keep.
+func keptExports() int {
+	if *workDir == "" {
+		return 0
+	}
+	return *keepExports
+}
+
+func processDb(name string, keys []hsm.Key, pub apkgdb.Publisher) error {
+	// instanciate db, export only keeps the files
+	tempDir, cleanup, err := workDirectory(pub == nil)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tempDir)
+	defer cleanup()
 
-	dir := filepath.Join(os.Getenv("HOME"), "projects/apkg-tools/repo/apkg/dist", name)
+	dir := filepath.Join(*repoDir, name)
 	files := make(map[fileKey]*apkgdb.DB)
 
 	err = filepath.Walk(dir, func(fpath string, info os.FileInfo, walkErr error) error {
@@ -50,11 +76,12 @@ func processDb(name string, k hsm.Key) error {
 				db, ok := files[fk]
 				if !ok {
 					// invoking db here will cause download of the whole db as currently known
-					db, err = apkgdb.NewOsArch(apkgdb.PKG_URL_PREFIX, name, path.Join(tempDir, fk.os, fk.arch), fk.os, fk.arch)
+					db, err = apkgdb.NewOsArch(*mirrors, name, path.Join(tempDir, fk.os, fk.arch), fk.os, fk.arch)
 					if err != nil {
 						return err
 					}
 
+					db.SetKeepExports(keptExports())
 					files[fk] = db
 				}
 
@@ -88,11 +115,12 @@ func processDb(name string, k hsm.Key) error {
 		db, ok := files[fk]
 		if !ok {
 			// invoking db here will cause download of the whole db as currently known
-			db, err = apkgdb.NewOsArch(apkgdb.PKG_URL_PREFIX, name, path.Join(tempDir, meta.Os, meta.Arch), meta.Os, meta.Arch)
+			db, err = apkgdb.NewOsArch(*mirrors, name, path.Join(tempDir, meta.Os, meta.Arch), meta.Os, meta.Arch)
 			if err != nil {
 				return err
 			}
 
+			db.SetKeepExports(keptExports())
 			files[fk] = db
 		}
 
@@ -107,7 +135,7 @@ func processDb(name string, k hsm.Key) error {
 	}
 
 	for _, db := range files {
-		err = db.ExportAndUpload(k)
+		err = db.Export(pub, keys...)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgdb"
+)
+
+const revokeUsage = `usage:
+	apkg-index [flags] revoke list
+	apkg-index [flags] revoke add <key> [cutoff]
+	apkg-index [flags] revoke rm <key>`
+
+// revokeChange is a difference between the revocations of two database
+// states
+type revokeChange struct {
+	key      string
+	old, new time.Time // zero when the key is not revoked
+}
+
+func (c revokeChange) String() string {
+	switch {
+	case c.old.IsZero():
+		return fmt.Sprintf("+ %s since %s", c.key, c.new.UTC().Format(time.RFC3339))
+	case c.new.IsZero():
+		return fmt.Sprintf("- %s (was since %s)", c.key, c.old.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("~ %s: since %s → %s", c.key, c.old.UTC().Format(time.RFC3339), c.new.UTC().Format(time.RFC3339))
+}
+
+// diffRevocations returns the changes between two sets of revocations (key →
+// cutoff), sorted by key.
+func diffRevocations(before, after map[string]time.Time) []revokeChange {
+	var res []revokeChange
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !old.Equal(v) {
+			res = append(res, revokeChange{key: k, old: old, new: v})
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			res = append(res, revokeChange{key: k, old: v})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+	return res
+}
+
+// parseCutoff parses a revocation cutoff, either a RFC 3339 time or a date
+// (midnight UTC). An empty string means now.
+func parseCutoff(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid cutoff %q, expected a RFC 3339 time or a date", s)
+}
+
+// applyRevokeCommand changes the revocations of db according to args
+func applyRevokeCommand(db *apkgdb.DB, args []string, now time.Time) error {
+	switch args[0] {
+	case "add":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New(revokeUsage)
+		}
+		var cutoff string
+		if len(args) == 3 {
+			cutoff = args[2]
+		}
+		t, err := parseCutoff(cutoff, now)
+		if err != nil {
+			return err
+		}
+		return db.Revoke(args[1], t)
+	case "rm":
+		if len(args) != 2 {
+			return errors.New(revokeUsage)
+		}
+		if _, ok := db.Revocations()[args[1]]; !ok {
+			return fmt.Errorf("key %s is not revoked", args[1])
+		}
+		return db.DeleteRevocation(args[1])
+	}
+	return errors.New(revokeUsage)
+}
+
+// revokeCommand runs the revoke subcommand on all the target databases, and
+// exports the databases that changed once confirmed.
+func revokeCommand(name string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(revokeUsage)
+	}
+
+	// the same cutoff for all the databases
+	now := time.Now()
+
+	return editDatabases(name, args[0] == "list", func(fk fileKey, db *apkgdb.DB) (bool, error) {
+		if args[0] == "list" {
+			if len(args) != 1 {
+				return false, errors.New(revokeUsage)
+			}
+			listRevocations(os.Stdout, fk, db.Revocations())
+			return false, nil
+		}
+
+		before := db.Revocations()
+		if err := applyRevokeCommand(db, args, now); err != nil {
+			return false, err
+		}
+		return printChanges(fk, diffRevocations(before, db.Revocations())), nil
+	})
+}
+
+func listRevocations(w io.Writer, fk fileKey, revoked map[string]time.Time) {
+	keys := make([]string, 0, len(revoked))
+	for k := range revoked {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "%s/%s:\n", fk.os, fk.arch)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s since %s\n", k, revoked[k].UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffRevocations(t *testing.T) {
+	t1 := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	before := map[string]time.Time{"keyA": t1, "keyB": t1}
+	after := map[string]time.Time{"keyA": t2, "keyC": t2}
+
+	var got []string
+	for _, c := range diffRevocations(before, after) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"~ keyA: since 2025-03-01T00:00:00Z → 2025-04-01T00:00:00Z",
+		"- keyB (was since 2025-03-01T00:00:00Z)",
+		"+ keyC since 2025-04-01T00:00:00Z",
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	if d := diffRevocations(after, after); len(d) != 0 {
+		t.Errorf("expected no change, got %v", d)
+	}
+}
+
+func TestParseCutoff(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"":                     now,
+		"2025-03-01":           time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2025-03-01T10:00:00Z": time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC),
+	}
+	for in, want := range tests {
+		if v, err := parseCutoff(in, now); err != nil || !v.Equal(want) {
+			t.Errorf("parseCutoff(%q) = %s, %v, want %s", in, v, err, want)
+		}
+	}
+	if _, err := parseCutoff("yesterday", now); err == nil {
+		t.Errorf("invalid cutoff should have been refused")
+	}
+}
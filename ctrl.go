@@ -36,6 +36,9 @@ func init() {
 
 		fmt.Fprintf(w, "apkg control channel\n\n")
 		fmt.Fprintf(w, "apkgdb: db related endpoints\n")
+		for _, i := range databases {
+			fmt.Fprintf(w, "  apkgdb/%s\n", i.cfg.Name)
+		}
 	})
 
 	http.HandleFunc("/_stack", func(w http.ResponseWriter, r *http.Request) {
@@ -44,12 +47,17 @@ func init() {
 	})
 }
 
-func listenCtrl() {
-	p := 100
-
-	if uid := os.Getuid(); uid != 0 {
-		p = 10000
+// ctrlPort returns the port of the control interface, which depends on
+// whether the daemon runs as root
+func ctrlPort() int {
+	if os.Getuid() != 0 {
+		return 10000
 	}
+	return 100
+}
+
+func listenCtrl() {
+	p := ctrlPort()
 
 	lTcp, err := net.ListenTCP("tcp", &net.TCPAddr{Port: p})
 	if err != nil {
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AzusaOS/apkg/apkgdb"
+	"github.com/AzusaOS/apkg/apkgfs"
+)
+
+// dbConfig describes a database served by the daemon, as listed in the
+// -databases file:
+//
+//	[
+//		{"name": "main", "overlays": ["corp"]},
+//		{"name": "corp", "mirrors": ["https://apkg.corp.example/"], "channel": "latest", "signers": ["corp"]}
+//	]
+type dbConfig struct {
+	Name     string   `json:"name"`
+	Mirrors  []string `json:"mirrors"`            // default -mirrors, empty for offline
+	Channel  string   `json:"channel,omitempty"`  // default -channel
+	Signers  []string `json:"signers,omitempty"`  // names of the trusted keys allowed to sign it, default all
+	Overlays []string `json:"overlays,omitempty"` // databases looked up before this one in its mount, highest priority first
+}
+
+// mirrorList returns the mirrors of the database, in the format of -mirrors
+func (c *dbConfig) mirrorList() string {
+	if c.Mirrors == nil {
+		return *mirrors
+	}
+	return strings.Join(c.Mirrors, ",")
+}
+
+func (c *dbConfig) channel() string {
+	if c.Channel == "" {
+		return *channel
+	}
+	return c.Channel
+}
+
+// loadDbConfig reads the list of databases to serve. Without a file, only
+// main is served.
+func loadDbConfig(fn string) ([]*dbConfig, error) {
+	def := []*dbConfig{{Name: "main"}}
+	if fn == "" {
+		return def, nil
+	}
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return def, nil
+		}
+		return nil, err
+	}
+
+	var res []*dbConfig
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s: no database", fn)
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range res {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/.") || c.Name[0] == '_' {
+			return nil, fmt.Errorf("%s: invalid database name %q", fn, c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("%s: database %s listed twice", fn, c.Name)
+		}
+		seen[c.Name] = true
+	}
+	for _, c := range res {
+		for _, o := range c.Overlays {
+			if o == c.Name || !seen[o] {
+				return nil, fmt.Errorf("%s: invalid overlay %q for database %s", fn, o, c.Name)
+			}
+		}
+	}
+	return res, nil
+}
+
+// dbInstance is a database served and mounted by the daemon
+type dbInstance struct {
+	cfg *dbConfig
+	db  *apkgdb.DB
+	fs  *apkgfs.PkgFS
+}
+
+// openDb loads the n-th database from the data directory p, and registers
+// its control endpoints.
+func openDb(n int, c *dbConfig, p string, cacheLim int64) (*apkgdb.DB, error) {
+	db, err := apkgdb.New(c.mirrorList(), c.Name, p)
+	if err != nil {
+		return nil, err
+	}
+	// each database has its own inode range, so they can be layered
+	db.SetInodeBase(uint64(n) << 40)
+	db.SetChannel(c.channel())
+	db.SetSigners(c.Signers)
+	loadPinOverrides(db)
+	loadChannelMap(db)
+	db.SetMaxAge(*maxAgeWarn, *maxAge)
+	db.SetCacheLimit(cacheLim)
+	db.SetListShort(*listShort)
+	db.SetPrefetchNeeded(*prefetchLibs)
+
+	http.Handle("/apkgdb/"+c.Name, db)
+	http.Handle("/apkgdb/"+c.Name+"/", db)
+	return db, nil
+}
+
+// mount mounts the database at <base>/<name>, on top of its overlays if any
+func (i *dbInstance) mount(base string) error {
+	var root apkgfs.RootInode = i.db
+	var layers *apkgdb.Layers
+
+	if len(i.cfg.Overlays) > 0 {
+		var dbs []*apkgdb.DB
+		for _, name := range i.cfg.Overlays {
+			if o := getDb(name); o != nil {
+				dbs = append(dbs, o.db)
+			} else {
+				log.Printf("apkg: overlay %s of %s is not available", name, i.cfg.Name)
+			}
+		}
+		if len(dbs) > 0 {
+			var err error
+			layers, err = apkgdb.NewLayers(append(dbs, i.db)...)
+			if err != nil {
+				return err
+			}
+			root = layers
+		}
+	}
+
+	mp, err := apkgfs.New(filepath.Join(base, i.cfg.Name), root)
+	if err != nil {
+		return err
+	}
+	i.fs = mp
+	if layers != nil {
+		layers.SetNotifyTarget(mp)
+	} else {
+		i.db.AddNotifyTarget(mp)
+	}
+	go mp.Serve()
+	return nil
+}
+
+// getDb returns the served database with the given name, or nil
+func getDb(name string) *dbInstance {
+	for _, i := range databases {
+		if i.cfg.Name == name {
+			return i
+		}
+	}
+	return nil
+}
+
+// reloadDbs reloads the local configuration of all databases and checks for
+// updates.
+func reloadDbs() {
+	for _, i := range databases {
+		loadPinOverrides(i.db)
+		loadChannelMap(i.db)
+		go i.db.Update()
+	}
+}
+
+func gracefulRestart() {
+	exec, err := os.Executable()
+	if err != nil {
+		log.Printf("apkg: graceful restart failed: cannot determine executable: %s", err)
+		return
+	}
+	var servers []*apkgfs.FuseServer
+	for _, i := range databases {
+		if i.fs == nil || i.fs.FuseServer() == nil {
+			log.Printf("apkg: graceful restart not available (no FUSE server for %s)", i.cfg.Name)
+			return
+		}
+		servers = append(servers, i.fs.FuseServer())
+	}
+	if len(servers) == 0 {
+		log.Printf("apkg: graceful restart not available (no FUSE server)")
+		return
+	}
+	log.Printf("apkg: performing graceful restart...")
+	if err := apkgfs.GracefulExec(exec, servers...); err != nil {
+		log.Printf("apkg: graceful restart failed: %s", err)
+	}
+}
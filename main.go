@@ -4,21 +4,33 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
 
 	"github.com/AzusaOS/apkg/apkgdb"
-	"github.com/AzusaOS/apkg/apkgfs"
+	"github.com/AzusaOS/apkg/apkgsig"
 )
 
 var (
-	dbMain       *apkgdb.DB
-	fuseFS       *apkgfs.PkgFS
+	databases    []*dbInstance
 	shutdownChan = make(chan struct{})
 	channel      = flag.String("channel", "stable", "release channel for version resolution (use \"latest\" for newest)")
+	maxAgeWarn   = flag.Duration("max_age_warn", apkgdb.DefaultMaxAgeWarn, "warn when the database was not updated for this long (0 to disable)")
+	maxAge       = flag.Duration("max_age", 0, "refuse database updates signed longer ago than this, to detect frozen mirrors (0 to disable)")
+	cacheLimit   = flag.String("cache_limit", "", "maximum disk space used by downloaded packages, for example 20G (default no limit)")
+	exportFile   = flag.String("export_bundle", "", "write the latest database and the packages given as arguments to this file, then exit")
+	prefetchPkgs = flag.Bool("prefetch", false, "ask the running daemon to download the packages given as arguments, wait until they are ready, then exit")
+	prefetchLibs = flag.Bool("prefetch_needed", true, "download in the background the packages providing the shared libraries of a package when it is first accessed")
+	importFile   = flag.String("import_bundle", "", "import a bundle created with -export_bundle on startup")
+	mirrors      = flag.String("mirrors", apkgdb.PKG_URL_PREFIX, "comma separated list of URL prefixes to download from, tried in order")
+	listShort    = flag.Bool("list_short", false, "list package names without version in the mount root")
+	dbSigs       = flag.Int("db_signatures", apkgsig.DefaultDbThreshold, "number of distinct trusted keys that must have signed a database")
+	trustDir     = flag.String("trust_dir", "/etc/apkg/trust.d", "directory of additional trusted signing keys, reloaded on SIGHUP")
+	pinFile      = flag.String("pin_overrides", "/etc/apkg/pins.conf", "file of local version pins overriding the channel, reloaded on SIGHUP")
+	channelFile  = flag.String("channel_map", "/etc/apkg/channels.conf", "file selecting the channel by uid or cgroup of the caller, reloaded on SIGHUP")
+	dbFile       = flag.String("databases", "/etc/apkg/databases.json", "JSON file listing the databases to serve (default only main)")
 )
 
 func shutdown() {
@@ -26,22 +38,6 @@ func shutdown() {
 	close(shutdownChan)
 }
 
-func gracefulRestart() {
-	exec, err := os.Executable()
-	if err != nil {
-		log.Printf("apkg: graceful restart failed: cannot determine executable: %s", err)
-		return
-	}
-	if fuseFS == nil || fuseFS.FuseServer() == nil {
-		log.Printf("apkg: graceful restart not available (no FUSE server)")
-		return
-	}
-	log.Printf("apkg: performing graceful restart...")
-	if err := fuseFS.FuseServer().GracefulExec(exec); err != nil {
-		log.Printf("apkg: graceful restart failed: %s", err)
-	}
-}
-
 func setupSignals() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -57,7 +53,8 @@ func setupSignals() {
 				return
 			case syscall.SIGHUP:
 				// reload
-				go dbMain.Update()
+				loadTrust()
+				reloadDbs()
 			case syscall.SIGUSR2:
 				// graceful restart
 				go gracefulRestart()
@@ -66,6 +63,52 @@ func setupSignals() {
 	}()
 }
 
+// loadTrust loads the local trust store, keeping the keys from files that
+// could be read if some are invalid.
+func loadTrust() {
+	if *trustDir == "" {
+		return
+	}
+	if err := apkgsig.LoadTrustDir(*trustDir); err != nil {
+		log.Printf("apkg: trust store: %s", err)
+	}
+	if n := len(apkgsig.LocalKeys()); n > 0 {
+		log.Printf("apkg: loaded %d local trusted keys from %s", n, *trustDir)
+	}
+}
+
+func loadPinOverrides(d *apkgdb.DB) {
+	if *pinFile == "" {
+		return
+	}
+	pins, err := apkgdb.LoadPinOverrides(*pinFile)
+	if err != nil {
+		// keep the current overrides
+		log.Printf("apkg: pin overrides: %s", err)
+		return
+	}
+	d.SetPinOverrides(pins)
+	if len(pins) > 0 {
+		log.Printf("apkg: loaded %d local pin overrides from %s", len(pins), *pinFile)
+	}
+}
+
+func loadChannelMap(d *apkgdb.DB) {
+	if *channelFile == "" {
+		return
+	}
+	rules, err := apkgdb.LoadChannelMap(*channelFile)
+	if err != nil {
+		// keep the current rules
+		log.Printf("apkg: channel map: %s", err)
+		return
+	}
+	d.SetChannelMap(rules)
+	if len(rules) > 0 {
+		log.Printf("apkg: loaded %d channel rules from %s", len(rules), *channelFile)
+	}
+}
+
 func setRlimit() {
 	var rLimit syscall.Rlimit
 	rLimit.Cur = 65536
@@ -76,14 +119,47 @@ func setRlimit() {
 func main() {
 	flag.Parse()
 
+	apkgsig.SetDbThreshold(*dbSigs)
+	loadTrust()
+
+	cfgs, err := loadDbConfig(*dbFile)
+	if err != nil {
+		log.Printf("apkg: %s", err)
+		os.Exit(1)
+	}
+
+	if *exportFile != "" {
+		// bundles hold the first database
+		if err := exportBundle(cfgs[0], *exportFile, flag.Args()); err != nil {
+			log.Printf("apkg: failed to export bundle: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *prefetchPkgs {
+		// like bundles, use the first database
+		if err := prefetch(cfgs[0], flag.Args()); err != nil {
+			log.Printf("apkg: prefetch failed: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Printf("apkg: Starting apkg daemon built on %s", DATE_TAG)
 	setRlimit()
 	setupSignals()
 
-	db := "main"
-	var err error
+	var cacheLim int64
+	if *cacheLimit != "" {
+		cacheLim, err = apkgdb.ParseSize(*cacheLimit)
+		if err != nil {
+			log.Printf("apkg: bad value for -cache_limit: %s", err)
+			return
+		}
+	}
 
-	// instanciate database
+	// instanciate databases
 	p := "/var/lib/apkg"
 	base := "/pkg"
 
@@ -106,28 +182,37 @@ func main() {
 			base = filepath.Join(h, "pkg")
 		}
 	}
-	dbMain, err = apkgdb.New(apkgdb.PKG_URL_PREFIX, db, p)
-	if err != nil {
-		log.Printf("db: failed to load: %s", err)
+
+	for n, c := range cfgs {
+		db, err := openDb(n, c, p, cacheLim)
+		if err != nil {
+			log.Printf("db: failed to load %s: %s", c.Name, err)
+			continue
+		}
+		if n == 0 && *importFile != "" {
+			if err := importBundle(db, *importFile); err != nil {
+				log.Printf("apkg: failed to import bundle: %s", err)
+			}
+		}
+		databases = append(databases, &dbInstance{cfg: c, db: db})
+	}
+	if len(databases) == 0 {
 		return
 	}
-	dbMain.SetChannel(*channel)
-	http.Handle("/apkgdb/"+db, dbMain)
 
-	// mount database
-	mp, err := apkgfs.New(filepath.Join(base, db), dbMain)
-	if err != nil {
-		fmt.Printf("Mount fail: %s\n", err)
-		os.Exit(1)
+	// mount databases
+	for _, i := range databases {
+		if err := i.mount(base); err != nil {
+			fmt.Printf("Mount fail: %s\n", err)
+			os.Exit(1)
+		}
+		defer i.fs.Unmount()
 	}
-	fuseFS = mp
-
-	dbMain.SetNotifyTarget(mp)
-	go mp.Serve()
-	defer mp.Unmount()
 
-	// now that database is mounted, run updater
-	go updater(base)
+	// now that databases are mounted, run updater
+	if getDb("main") != nil {
+		go updater(base)
+	}
 	listenCtrl()
 
 	<-shutdownChan
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/AzusaOS/apkg/apkgdb"
+)
+
+// prefetch asks the running daemon to download the given packages of the
+// database c, and reports the progress until they are all ready.
+func prefetch(c *dbConfig, names []string) error {
+	u := fmt.Sprintf("http://127.0.0.1:%d/apkgdb/%s/v1/prefetch", ctrlPort(), url.PathEscape(c.Name))
+
+	body, err := json.Marshal(&apkgdb.APIPrefetchRequest{Names: names})
+	if err != nil {
+		return err
+	}
+
+	st := &apkgdb.PrefetchStatus{}
+	resp, err := http.Post(u, "application/json", bytes.NewReader(body))
+	if err := ctrlDecode(resp, err, st); err != nil {
+		return err
+	}
+	id := st.ID
+
+	last := ""
+	for {
+		pct := 100.0
+		if st.Blocks > 0 {
+			pct = float64(st.Verified) * 100 / float64(st.Blocks)
+		}
+		line := fmt.Sprintf("prefetch: %d/%d packages ready, %.1f%% verified", st.Ready, len(st.Packages), pct)
+		if line != last {
+			fmt.Fprintln(os.Stderr, line)
+			last = line
+		}
+		if st.State != "running" {
+			break
+		}
+
+		time.Sleep(time.Second)
+		st = &apkgdb.PrefetchStatus{}
+		resp, err := http.Get(fmt.Sprintf("%s?id=%d", u, id))
+		if err := ctrlDecode(resp, err, st); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, p := range st.Packages {
+		if p.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", p.Name, p.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ctrlDecode decodes into v the response to a call to the JSON API of the
+// control interface, err being the error returned by the call.
+func ctrlDecode(resp *http.Response, err error, v any) error {
+	if err != nil {
+		return fmt.Errorf("cannot reach the apkg daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("unexpected response from the apkg daemon: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}